@@ -8,10 +8,11 @@ import (
 	"github.com/elazarl/gosloppy/patch"
 )
 
-func NewAutoImporter(file *ast.File) *AutoImporter {
+// NewAutoImporter imports the standard packages the file in dir refers to, and does not import.
+func NewAutoImporter(file *ast.File, dir string) *AutoImporter {
 	auto := &AutoImporter{patch.Patches{}, make(map[*ast.Ident]bool), make(map[string]bool), file.Name.End()}
 	for _, imp := range file.Imports {
-		auto.m[imports.GetNameOrGuess(imp)] = true
+		auto.m[imports.GetNameOrGuessFrom(imp, dir)] = true
 	}
 	return auto
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/gosloppy/instrument"
+	"github.com/elazarl/gosloppy/patch"
+)
+
+// diffContext is the number of unchanged lines around every change, as in diff -u.
+const diffContext = 3
+
+// patchedFile is a file gosloppy patched, with its original and patched text.
+type patchedFile struct {
+	name    string
+	orig    string
+	patched string
+}
+
+// diffPackages writes to w a unified diff between every file gosloppy would patch to build or test
+// the packages given, or the package in the working directory, and the patched file. The packages
+// are instrumented as they would be for go test, without line directives, so that every file a
+// build or a test would patch is covered. Imports rewritten to the instrumented copies of the
+// packages they import are left out, as they only make sense in the instrumented tree.
+func diffPackages(interrupts *Interrupts, gocmd *instrument.GoCmd, opts *options, w io.Writer) {
+	pkgs := importPackages(gocmd, opts)
+	for _, pkg := range pkgs {
+		configure(pkg, gocmd, opts)
+		pkg.SetLineDirectives(false)
+	}
+	var mu sync.Mutex
+	var files []patchedFile
+	outdir, cleanup := workspace(interrupts, gocmd.BuildFlags.Bool("work"))
+	defer cleanup()
+	die(instrument.InstrumentAllTo(pkgs, true, outdir, func(file *patch.PatchableFile) (patch.Patches, error) {
+		patches, err := sloppyPatches(file)
+		if err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		if _, err := file.FprintPatched(buf, file.File, patches); err != nil {
+			// the instrumentation writes the same output, and would report the error
+			return patches, nil
+		}
+		if buf.String() != file.Orig {
+			mu.Lock()
+			files = append(files, patchedFile{file.FileName, file.Orig, buf.String()})
+			mu.Unlock()
+		}
+		return patches, nil
+	}))
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	for _, file := range files {
+		die(unifiedDiff(w, diffName(gocmd.WorkDir, file.name), file.orig, file.patched))
+	}
+}
+
+// diffName returns the name of the file in the diff header, relative to workdir if the file is
+// below it.
+func diffName(workdir, file string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	if wd, err := filepath.Abs(workdir); err == nil {
+		if rel, err := filepath.Rel(wd, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(abs)
+}
+
+// edit is a line of a diff, kept (' '), removed ('-') or added ('+').
+type edit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff writes the diff between the texts a and b of the file name in the unified format,
+// which patch -p0 applies to the original file. It writes nothing if the texts are equal.
+func unifiedDiff(w io.Writer, name string, a, b string) error {
+	edits := diffLines(splitLines(a), splitLines(b))
+	buf := new(bytes.Buffer)
+	// aline and bline are the number of lines of a and b before edits[i]
+	aline, bline := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			aline, bline, i = aline+1, bline+1, i+1
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// the hunk ends once the changes are more than twice the context apart
+		end, kept := i, 0
+		for ; end < len(edits) && kept <= 2*diffContext; end++ {
+			if edits[end].op == ' ' {
+				kept++
+			} else {
+				kept = 0
+			}
+		}
+		end -= kept - diffContext
+		if end > len(edits) {
+			end = len(edits)
+		}
+		astart, bstart := aline-(i-start), bline-(i-start)
+		acount, bcount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				acount++
+			}
+			if e.op != '-' {
+				bcount++
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(buf, "--- %s\n+++ %s\n", name, name)
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(astart, acount), hunkRange(bstart, bcount))
+		for _, e := range edits[start:end] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		aline, bline, i = astart+acount, bstart+bcount, end
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// hunkRange formats the range of count lines after line start, as diff -u does.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s after every newline. The last line lacks one if s does not end with a newline.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning a to b, with Myers' algorithm. Its cost is
+// proportional to the size of the texts times the number of changes, which gosloppy keeps small.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	// v[max+k] is the furthest x reached on diagonal k, and trace the v of every step
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack follows the trace of diffLines back from the end of a and b.
+func backtrack(a, b []string, trace [][]int) []edit {
+	max := len(a) + len(b)
+	x, y := len(a), len(b)
+	var edits []edit
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevk := k - 1
+		if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+			prevk = k + 1
+		}
+		prevx := v[max+prevk]
+		prevy := prevx - prevk
+		for x > prevx && y > prevy {
+			edits = append(edits, edit{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevx {
+			edits = append(edits, edit{'+', b[y-1]})
+		} else {
+			edits = append(edits, edit{'-', a[x-1]})
+		}
+		x, y = prevx, prevy
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
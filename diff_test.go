@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		s := ""
+		for i := from; i <= to; i++ {
+			s += string(rune('a'+i-1)) + "\n"
+		}
+		return s
+	}
+	for _, c := range []struct {
+		a, b string
+		exp  string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "@@ -1 +0,0 @@\n-a\n"},
+		{"a\nb", "a\nb\n", "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		// changes far apart are in separate hunks, with three lines of context
+		{lines(1, 20), lines(1, 2) + "x\n" + lines(3, 17) + "y\n" + lines(18, 20),
+			"@@ -1,5 +1,6 @@\n a\n b\n+x\n c\n d\n e\n" +
+				"@@ -15,6 +16,7 @@\n o\n p\n q\n+y\n r\n s\n t\n"},
+		// and close ones in the same hunk
+		{lines(1, 10), lines(1, 3) + lines(5, 7) + "x\n" + lines(8, 10),
+			"@@ -1,10 +1,10 @@\n a\n b\n c\n-d\n e\n f\n g\n+x\n h\n i\n j\n"},
+	} {
+		buf := new(bytes.Buffer)
+		if err := unifiedDiff(buf, "f.go", c.a, c.b); err != nil {
+			t.Fatal(err)
+		}
+		exp := c.exp
+		if exp != "" {
+			exp = "--- f.go\n+++ f.go\n" + exp
+		}
+		if buf.String() != exp {
+			t.Errorf("diff of %q and %q\nExpected:\n%s\nGot:\n%s", c.a, c.b, exp, buf.String())
+		}
+	}
+}
+
+func TestDiffName(t *testing.T) {
+	if name := diffName("/a/b", "/a/b/c/d.go"); name != "c/d.go" {
+		t.Error("Expected c/d.go got", name)
+	}
+	if name := diffName("/a/b", "/a/bc/d.go"); !strings.HasSuffix(name, "/a/bc/d.go") {
+		t.Error("Expected an absolute path got", name)
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":      "module example.com/m\n",
+		"a/a.go":      "package main\n\nimport \"example.com/m/b\"\n\nfunc main() {\n\ti := 1\n\tb.B()\n}\n",
+		"b/b.go":      "package b\n\nimport \"fmt\"\n\nfunc B() {}\n",
+		"b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) { j := 2 }\n",
+		"c/c.go":      "package c\n",
+	} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOFLAGS", "")
+	t.Chdir(root)
+	gocmd, err := instrument.NewGoCmd(".", "go", "diff", "./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	diffPackages(&Interrupts{}, gocmd, &options{"", true, false, false}, buf)
+	exp := "--- a/a.go\n+++ a/a.go\n@@ -3,6 +3,6 @@\n import \"example.com/m/b\"\n \n func main() {\n-\ti := 1\n+\ti := 1;_ = i\n \tb.B()\n }\n" +
+		"--- b/b.go\n+++ b/b.go\n@@ -1,5 +1,5 @@\n package b\n \n-import \"fmt\"\n+import _ \"fmt\"\n \n func B() {}\n" +
+		"--- b/b_test.go\n+++ b/b_test.go\n@@ -2,4 +2,4 @@\n \n import \"testing\"\n \n-func TestB(t *testing.T) { j := 2 }\n+func TestB(t *testing.T) { j := 2;_ = j }\n"
+	if buf.String() != exp {
+		t.Errorf("Expected diff:\n%s\nGot:\n%s", exp, buf.String())
+	}
+}
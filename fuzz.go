@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+// fuzzArgs returns the arguments the test binary of pkg needs for fuzzing, if -fuzz is given.
+// The binary runs in the original package directory, so the seed corpus is read from, and new
+// failing inputs are written to, the original testdata/fuzz directory.
+func fuzzArgs(gocmd *instrument.GoCmd, pkg *instrument.Instrumentable) []string {
+	if gocmd.BuildFlags.Get("fuzz") == "" {
+		return nil
+	}
+	dir, err := fuzzCacheDir(gocmd, pkg)
+	die(err)
+	return []string{"-test.fuzzcachedir=" + dir}
+}
+
+// fuzzCacheDir returns the directory go test keeps the generated corpus of pkg in, so that
+// fuzzing a sloppy package continues where go test -fuzz stopped, and vice versa. GOCACHE is the
+// one gocmd runs with.
+func fuzzCacheDir(gocmd *instrument.GoCmd, pkg *instrument.Instrumentable) (string, error) {
+	env := exec.Command(gocmd.Executable, "env", "GOCACHE")
+	env.Dir, env.Env = gocmd.WorkDir, append(os.Environ(), gocmd.Env...)
+	out, err := env.Output()
+	if err != nil {
+		return "", err
+	}
+	gocache := strings.TrimSpace(string(out))
+	if gocache == "" || gocache == "off" {
+		return "", errors.New("fuzzing requires the build cache, but GOCACHE is off")
+	}
+	return filepath.Join(gocache, "fuzz", displayName(pkg)), nil
+}
+
+// packageDir returns the directory of the original package, where its tests should run.
+func packageDir(pkg *instrument.Instrumentable, workdir string) string {
+	if dir := pkg.Package().Dir; dir != "" {
+		return dir
+	}
+	return workdir
+}
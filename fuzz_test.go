@@ -0,0 +1,42 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+func TestFuzzCacheDir(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "m.go"), []byte("package m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOFLAGS", "")
+	t.Chdir(root)
+	pkg, err := instrument.ImportContext(&build.Default, "", "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the corpus is kept by import path, as go test -fuzz keeps it, in the GOCACHE of the go command
+	cache := filepath.Join(root, "cache")
+	gocmd, err := instrument.NewGoCmd(".", "go", "test", "-fuzz", "FuzzX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gocmd.Env = []string{"GOCACHE=" + cache}
+	if dir, err := fuzzCacheDir(gocmd, pkg); err != nil || dir != filepath.Join(cache, "fuzz", "example.com", "m") {
+		t.Errorf("Expected %s got %s (%v)", filepath.Join(cache, "fuzz", "example.com", "m"), dir, err)
+	}
+	gocmd.Env = []string{"GOCACHE=off"}
+	if dir, err := fuzzCacheDir(gocmd, pkg); err == nil {
+		t.Error("Expected an error with the build cache off, got", dir)
+	}
+}
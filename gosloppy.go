@@ -4,12 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"go/ast"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"strconv"
 
+	"github.com/elazarl/gosloppy/imports"
 	"github.com/elazarl/gosloppy/instrument"
 	"github.com/elazarl/gosloppy/patch"
 )
@@ -107,9 +109,13 @@ func (p *patchUnused) UnusedImport(imp *ast.ImportSpec) {
 func usage() {
 	fmt.Println(`Usage:
 run tests:
-gosloppy test <go test switches>
+gosloppy test <go test switches> [packages]
 build a binary:
-gosloppy build <go build switches>`)
+gosloppy build <go build switches> [packages]
+show the changes gosloppy makes to the sources, as a unified diff, but for imports rewritten to
+the instrumented packages:
+gosloppy diff <go build switches> [packages]
+packages may be patterns such as ./...`)
 }
 
 type exitCode int
@@ -121,6 +127,96 @@ func die(err error) {
 	}
 }
 
+// sloppyPatches returns the patches making p compile despite unused variables and imports,
+// missing imports and ignored errors.
+// Files are instrumented concurrently, visitors must not be shared between them.
+// Should the visitors contradict each other, the *patch.ConflictError naming them is returned.
+func sloppyPatches(p *patch.PatchableFile) (patch.Patches, error) {
+	patches := &patchUnused{patch.Patches{}}
+	shorterror := (&ShortError{}).SetFile(p)
+	dir := filepath.Dir(p.FileName)
+	autoimport := NewAutoImporter(p.File, dir)
+	WalkFile(NewMultiVisitor(NewUnusedVisitor(patches, dir), autoimport, shorterror), p.File)
+	return p.Merge(patch.Set{Name: "unused", Patches: patches.patches},
+		patch.Set{Name: "autoimport", Patches: autoimport.Patches},
+		patch.Set{Name: "must", Patches: shorterror.Patches()})
+}
+
+// options are the flags of gosloppy itself, rather than of the go tool.
+type options struct {
+	basedir        string
+	linedirectives bool
+	ignored        bool
+	vendor         bool
+}
+
+func configure(pkg *instrument.Instrumentable, gocmd *instrument.GoCmd, opts *options) {
+	// cover profiles are mapped to the original sources with the source map, which would map again
+	// the positions cmd/cover takes from line directives
+	pkg.SetLineDirectives(opts.linedirectives && !coverage(gocmd))
+	pkg.SetVendor(opts.vendor)
+	if basepkg, why := pkg.Basepkg(); why != "" && gocmd.BuildFlags.Bool("x") {
+		log.Printf("Instrumenting packages below %s with %s: %s", basepkg, pkg.Package().ImportPath, why)
+	}
+	if parallel, err := strconv.Atoi(gocmd.BuildFlags.Get("p")); err == nil {
+		pkg.SetParallel(parallel)
+	}
+}
+
+// coverage reports whether gocmd builds tests with coverage.
+func coverage(gocmd *instrument.GoCmd) bool {
+	for _, flag := range []string{"covermode", "coverpkg", "coverprofile"} {
+		if gocmd.BuildFlags.Get(flag) != "" {
+			return true
+		}
+	}
+	return gocmd.BuildFlags.Bool("cover")
+}
+
+// workspace creates the temporary dir to instrument to, and returns it with a function
+// removing it, unless work is set, in which case it is kept and reported.
+func workspace(interrupts *Interrupts, work bool) (outdir string, cleanup func()) {
+	outdir, err := instrument.TempDir()
+	die(err)
+	if work {
+		log.Println("Instrumenting to", outdir)
+	}
+	cleanup = func() {
+		if !work {
+			if err := os.RemoveAll(outdir); err != nil {
+				log.Println("Cannot remove temporary dir", outdir, err)
+			}
+		}
+	}
+	interrupts.OnInterrupt(cleanup)
+	return outdir, cleanup
+}
+
+// exitOnError exits with the exit status of a failed child process, or dies on any other error.
+func exitOnError(err error) {
+	if status, ok := exitStatus(err); ok {
+		panic(exitCode(status))
+	}
+	die(err)
+}
+
+// command returns a command running prog with args, through execprog if it is not empty.
+func command(execprog []string, prog string, args ...string) *exec.Cmd {
+	if len(execprog) == 0 {
+		return exec.Command(prog, args...)
+	}
+	return exec.Command(execprog[0], append(append(execprog[1:], prog), args...)...)
+}
+
+func rewriteCoverProfileTo(sourcemap *instrument.SourceMap, instrumented string, w io.Writer) error {
+	r, err := os.Open(instrumented)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return sourcemap.RewriteCoverProfile(r, w)
+}
+
 func mvToDir(srcdir, file, dstdir string) error {
 	return os.Rename(filepath.Join(srcdir, file), filepath.Join(dstdir, file))
 }
@@ -139,105 +235,36 @@ func main() {
 			}
 		}
 	}()
+	interrupts := HandleInterrupts()
 	f := flag.NewFlagSet("", flag.ContinueOnError)
-	basedir := f.String("basedir", "", "instrument all packages decendant f basedir")
+	opts := &options{}
+	f.StringVar(&opts.basedir, "basedir", "", "instrument all packages decendant f basedir")
+	f.BoolVar(&opts.linedirectives, "linedirectives", true, "keep reported columns correct with line directives")
+	f.BoolVar(&opts.ignored, "ignored", false, "also compile files excluded by build constraints, with tags including them")
+	f.BoolVar(&opts.vendor, "vendor", false, "instrument vendored packages too, rather than build them as they are")
 	gocmd, err := instrument.NewGoCmdWithFlags(f, ".", os.Args...)
 	die(err)
-	var pkg *instrument.Instrumentable
-	if gocmd.Command == "run" {
-		pkg = instrument.ImportFiles(*basedir, gocmd.Params...)
-	} else if len(gocmd.Params) == 0 {
-		wd, err := os.Getwd()
-		if err != nil {
-			panic(exitCode(2))
-		}
-		for _, path := range filepath.SplitList(os.Getenv("GOPATH")) {
-			path = filepath.Join(path, "src")
-			if strings.Contains(wd, path) {
-				rel, err := filepath.Rel(path, wd)
-				die(err)
-				pkg, err = instrument.Import(*basedir, rel)
-				die(err)
-				break
-			}
-		}
-		path := filepath.Join(os.Getenv("GOROOT"), "src", "pkg")
-		if strings.Contains(wd, path) {
-			rel, err := filepath.Rel(path, wd)
-			die(err)
-			pkg, err = instrument.Import(*basedir, rel)
-			die(err)
-		}
-		if pkg == nil {
-			pkg, err = instrument.ImportDir(*basedir, ".")
-		}
-	} else {
-		pkg, err = instrument.Import(*basedir, gocmd.Params[0])
-	}
-	die(err)
-	shorterror := &ShortError{}
-	outdir, err := pkg.Instrument(gocmd.Command == "test", func(p *patch.PatchableFile) patch.Patches {
-		patches := &patchUnused{patch.Patches{}}
-		shorterror.SetFile(p)
-		autoimport := NewAutoImporter(p.File)
-		WalkFile(NewMultiVisitor(NewUnusedVisitor(patches), autoimport, shorterror), p.File)
-		return append(append(patches.patches, autoimport.Patches...), shorterror.Patches()...)
-	})
-	if gocmd.BuildFlags["work"] == "true" {
-		log.Println("Instrumenting to", outdir)
+	if gocmd.WorkDir != "." {
+		// packages are looked up from the working directory, which -C changes, as for the go tool
+		die(os.Chdir(gocmd.WorkDir))
+		gocmd.WorkDir = "."
 	}
-	defer func() {
-		if gocmd.BuildFlags["work"] != "true" {
-			if err := os.RemoveAll(outdir); err != nil {
-				log.Println("Cannot remove temporary dir", outdir, err)
-			}
-		}
-	}()
-	die(err)
-	newgocmd, err := gocmd.Retarget(outdir)
-	die(err)
-	newgocmd.Executable = "go"
-	// TODO(elazarl): Support build gofile.go gofile2.go
-	if newgocmd.Command != "run" {
-		newgocmd.Params = nil
-	}
-	if f.Lookup("x").Value.String() == "true" {
-		log.Println("In:", newgocmd.WorkDir)
-		log.Println("Executing:", newgocmd)
-	}
-	// TODO(elazarl): hackish, find better way
-	delete(newgocmd.BuildFlags, "basedir")
-	minusC := newgocmd.BuildFlags["c"] != ""
-	if newgocmd.Command == "test" {
-		newgocmd.BuildFlags["c"] = "true"
-	}
-	die(newgocmd.Runnable().Run())
-	if newgocmd.Command == "test" {
-		_, _, err := newgocmd.OutputFileName()
-		if err != nil {
-			panic("Cannot find package name, not producing test executable")
-		}
-		oldname, _, err := gocmd.OutputFileName()
-		if err != nil {
-			panic("Cannot find package name, not producing test executable")
-		}
-		// output name is unclear: http://code.google.com/p/go/issues/detail?id=5230
-		testoutput := filepath.Join(outdir, filepath.Base(outdir)+".test")
-		if minusC {
-			die(os.Rename(testoutput, oldname+".test"))
-		} else {
-			defer os.Remove(testoutput)
-			r := exec.Command(testoutput, newgocmd.ExtraFlags...)
-			r.Dir = gocmd.WorkDir
-			r.Stdin = os.Stdin
-			r.Stdout = os.Stdout
-			r.Stderr = os.Stderr
-			err := r.Run()
-			if err, ok := err.(*exec.ExitError); ok {
-				_ = err // TODO(elazar): pry from Go the actual exit code
-				panic(exitCode(-1))
-			}
-			die(err)
+	ctx := gocmd.Context()
+	imports.Context, imports.Getenv = ctx, gocmd.Getenv
+	// names of imported packages are kept for the next runs, best effort
+	if file, err := imports.CacheFile(ctx, gocmd.WorkDir); err == nil {
+		if cache, err := imports.OpenImportCache(file, imports.Stamp(ctx, gocmd.WorkDir)); err == nil {
+			imports.DefaultImportCache = cache
+			defer func() {
+				if err := cache.Save(); err != nil {
+					log.Println("Cannot save import cache", file, err)
+				}
+			}()
 		}
 	}
+	if gocmd.Command == "diff" {
+		diffPackages(interrupts, gocmd, opts, os.Stdout)
+		return
+	}
+	buildPackages(interrupts, gocmd, opts, importPackages(gocmd, opts))
 }
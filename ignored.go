@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+// checkIgnored compiles the files of pkg excluded by build constraints, which the build itself
+// never sees. For every build configuration including some of them, the package is instrumented
+// again, with that configuration, into a workspace of its own, and compiled there for its GOOS
+// and GOARCH. Tests are compiled as well for go test, and files no configuration includes are
+// warned about. It reports whether all configurations compiled.
+func checkIgnored(interrupts *Interrupts, gocmd *instrument.GoCmd, pkg *instrument.Instrumentable) bool {
+	withtests := gocmd.Command == "test"
+	configs, unsatisfiable, err := pkg.IgnoredConfigs(withtests)
+	die(err)
+	for _, file := range unsatisfiable {
+		fmt.Fprintf(os.Stderr, "warning: no build configuration includes %s\n", filepath.Join(pkg.Package().Dir, file))
+	}
+	ok := true
+	for _, config := range configs {
+		ok = checkConfig(interrupts, gocmd, pkg, config, withtests) && ok
+	}
+	return ok
+}
+
+func checkConfig(interrupts *Interrupts, gocmd *instrument.GoCmd, pkg *instrument.Instrumentable, config *instrument.BuildConfig, withtests bool) bool {
+	ctx := config.Context(gocmd.Context())
+	ipkg, err := pkg.Reimport(ctx)
+	die(err)
+	outdir, cleanup := workspace(interrupts, gocmd.BuildFlags.Bool("work"))
+	defer cleanup()
+	// the tags are not given to the go tool, since they would apply to the standard library too
+	die(ipkg.InstrumentTo(withtests, outdir, instrument.WithoutConstraints(sloppyPatches)))
+	newgocmd := &instrument.GoCmd{WorkDir: ipkg.OutDir(), Executable: "go", Command: "build", BuildFlags: gocmd.BuildFlags.Clone(),
+		Env: append(append([]string{}, gocmd.Env...), ipkg.GoEnv()...)}
+	for _, flag := range []string{"c", "exec", "json", "o"} {
+		newgocmd.BuildFlags.Delete(flag)
+	}
+	if overlay := goOverlay(gocmd, ipkg.SourceMap(), outdir); overlay != "" {
+		newgocmd.BuildFlags.Set("overlay", overlay)
+	}
+	if p := ipkg.Package(); withtests && len(p.TestGoFiles)+len(p.XTestGoFiles) > 0 {
+		newgocmd.Command = "test"
+		newgocmd.BuildFlags.Set("c", "true")
+		newgocmd.BuildFlags.Set("o", filepath.Join(outdir, "ignored.test"))
+	} else if ipkg.Package().Name == "main" {
+		newgocmd.BuildFlags.Set("o", filepath.Join(outdir, "ignored"))
+	}
+	files := strings.Join(config.Files, " ")
+	if gocmd.BuildFlags.Bool("v") || gocmd.BuildFlags.Bool("x") {
+		fmt.Fprintf(os.Stderr, "# %s: checking %s with %s\n", displayName(pkg), files, config)
+	}
+	logCommand(gocmd, newgocmd)
+	cmd := newgocmd.Runnable()
+	cmd.Env = append(cmd.Env, "GOOS="+ctx.GOOS, "GOARCH="+ctx.GOARCH)
+	if !ctx.CgoEnabled {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	}
+	err = runRewritten(interrupts, ipkg.SourceMap(), cmd, ipkg.OutDir(), false, os.Stdout, os.Stderr)
+	if _, ok := exitStatus(err); !ok {
+		die(err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s, excluded by build constraints, failed to build with %s\n", displayName(pkg), files, config)
+	}
+	return err == nil
+}
@@ -0,0 +1,259 @@
+package imports
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ImportCache caches the names of imported packages by the directory of the importing file and
+// the import path, so that a package is looked up once however many files import it. It is safe
+// for concurrent use, so that files instrumented concurrently share it.
+//
+// A cache opened with OpenImportCache is saved with Save, for the next runs. Only the names of
+// packages in directories the user does not edit, the module cache, GOROOT and the vendor directories
+// of modules, are saved, with a stamp of the go.mod and go.sum files and the toolchain they were read with.
+// In GOPATH mode every imported package is the user's to edit, so names are kept for the run alone.
+type ImportCache struct {
+	mu      sync.Mutex
+	imports map[importKey]cachedImport
+	// file is the file the cache is saved to, empty for a cache kept in memory only
+	file  string
+	stamp string
+	dirty bool
+}
+
+// importKey is an import path imported from a file of srcdir.
+type importKey struct {
+	srcdir string
+	path   string
+}
+
+// cachedImport is the package an import resolved to, dir is empty for packages not found, whose
+// name is guessed.
+type cachedImport struct {
+	dir  string
+	name string
+}
+
+// NewImportCache returns an empty cache, kept in memory only.
+func NewImportCache() *ImportCache {
+	return &ImportCache{imports: map[importKey]cachedImport{}}
+}
+
+// cacheFile is the content of the file an ImportCache is saved to.
+type cacheFile struct {
+	Stamp   string
+	Imports []cacheEntry
+}
+
+// cacheEntry is a saved import, Path imported from SrcDir resolving to the package Name in Dir.
+type cacheEntry struct {
+	SrcDir string
+	Path   string
+	Dir    string
+	Name   string
+}
+
+// OpenImportCache returns the cache saved to file, or an empty cache if the file does not exist,
+// cannot be parsed, or was saved with another stamp. Save saves the cache back to file.
+func OpenImportCache(file, stamp string) (*ImportCache, error) {
+	cache := &ImportCache{imports: map[importKey]cachedImport{}, file: file, stamp: stamp}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved cacheFile
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Stamp != stamp {
+		// the cache is rebuilt and overwrites the file
+		return cache, nil
+	}
+	for _, e := range saved.Imports {
+		cache.imports[importKey{e.SrcDir, e.Path}] = cachedImport{e.Dir, e.Name}
+	}
+	return cache, nil
+}
+
+// Save writes the names of the packages that do not change to the file the cache was opened
+// from, if they changed since. Caches kept in memory only are not saved.
+func (cache *ImportCache) Save() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.file == "" || !cache.dirty {
+		return nil
+	}
+	saved := cacheFile{Stamp: cache.stamp}
+	for key, imp := range cache.imports {
+		if imp.dir != "" && immutableDir(Context, imp.dir) {
+			saved.Imports = append(saved.Imports, cacheEntry{key.srcdir, key.path, imp.dir, imp.name})
+		}
+	}
+	// a stable order keeps the file the same for the same imports
+	sort.Slice(saved.Imports, func(i, j int) bool {
+		a, b := saved.Imports[i], saved.Imports[j]
+		return a.SrcDir < b.SrcDir || a.SrcDir == b.SrcDir && a.Path < b.Path
+	})
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cache.file), 0755); err != nil {
+		return err
+	}
+	// concurrent runs each write a complete file, and the last one wins
+	tmp, err := ioutil.TempFile(filepath.Dir(cache.file), filepath.Base(cache.file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cache.file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	cache.dirty = false
+	return nil
+}
+
+// Get returns the name cached for the package path imported from a file of srcdir.
+func (cache *ImportCache) Get(srcdir, path string) (name string, ok bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	imp, ok := cache.imports[importKey{absDir(srcdir), path}]
+	return imp.name, ok
+}
+
+func (cache *ImportCache) set(key importKey, imp cachedImport) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.imports[key] != imp {
+		cache.imports[key], cache.dirty = imp, true
+	}
+}
+
+// will get the package name, or guess it if absent
+func (cache *ImportCache) GetNameOrGuess(imp *ast.ImportSpec) string {
+	return cache.GetNameOrGuessFrom(imp, ".")
+}
+
+// GetNameOrGuessFrom returns the name of the package imp imports in a file of srcdir, which picks
+// the module, or vendor directory, the package is in. Names of packages that cannot be found
+// offline are guessed from their import path. Packages are looked up on a miss of the cache alone.
+func (cache *ImportCache) GetNameOrGuessFrom(imp *ast.ImportSpec, srcdir string) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	if rv, ok := Stdlib[imp.Path.Value]; ok {
+		return rv
+	}
+	key := importKey{absDir(srcdir), importPath(imp)}
+	if rv, ok := cache.Get(key.srcdir, key.path); ok {
+		return rv
+	}
+	resolved := cachedImport{resolveDir(Context, key.path, key.srcdir), ""}
+	if resolved.dir == "" {
+		resolved.name = GuessName(key.path)
+	} else {
+		resolved.name = packageName(Context, key.path, resolved.dir)
+	}
+	cache.set(key, resolved)
+	return resolved.name
+}
+
+// absDir returns the absolute name of dir, or dir if it has none.
+func absDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+// immutableDir reports whether the package in dir does not change while go.mod, go.sum and the
+// toolchain do not: a package of the module cache, of GOROOT, or of the vendor directory of a module.
+func immutableDir(ctx *build.Context, dir string) bool {
+	for _, root := range []string{modCacheRoot(ctx), ctx.GOROOT} {
+		if root != "" && strings.HasPrefix(dir, filepath.Clean(root)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	// the vendor directory of a module is written by go mod vendor, after go.mod and go.sum
+	if i := strings.Index(dir, string(filepath.Separator)+"vendor"+string(filepath.Separator)); i >= 0 {
+		return fileExists(ctx, filepath.Join(dir[:i], "vendor", "modules.txt"))
+	}
+	return false
+}
+
+// Stamp returns a stamp of what the names of imported packages in the module of dir depend on: its
+// go.mod, go.sum and vendor/modules.txt, the go.work of its workspace, the toolchain, and ctx.
+func Stamp(ctx *build.Context, dir string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, toolchainVersion(ctx), ctx.GOROOT, ctx.GOPATH, ctx.GOOS, ctx.GOARCH, ctx.BuildTags)
+	fmt.Fprintln(h, Getenv("GO111MODULE"), Getenv("GOMODCACHE"))
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	var files []string
+	if m := findModInfo(ctx, dir); m != nil {
+		files = append(files, filepath.Join(m.dir, "go.mod"), filepath.Join(m.dir, "go.sum"),
+			filepath.Join(m.dir, "vendor", "modules.txt"))
+	}
+	if work := FindWork(dir); work != "" {
+		files = append(files, work, work+".sum")
+	}
+	for _, file := range files {
+		data, _ := readFile(ctx, file)
+		fmt.Fprintf(h, "%s %d\n", file, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// toolchainVersion returns the version of the toolchain in GOROOT, as its VERSION file tells, or
+// the version gosloppy was built with.
+func toolchainVersion(ctx *build.Context) string {
+	if f, err := os.Open(filepath.Join(ctx.GOROOT, "VERSION")); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		if scanner.Scan() && scanner.Text() != "" {
+			return scanner.Text()
+		}
+	}
+	return runtime.Version()
+}
+
+// CacheFile returns the file the cache of the module, or the directory when in no module, of dir
+// is saved to, in the user cache directory.
+func CacheFile(ctx *build.Context, dir string) (string, error) {
+	cachedir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if m := findModInfo(ctx, dir); m != nil {
+		dir = m.dir
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(cachedir, "gosloppy", "imports", hex.EncodeToString(sum[:8])+".json"), nil
+}
@@ -0,0 +1,94 @@
+package imports
+
+import (
+	"go/ast"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestImportCacheSave(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"app/go.mod":                          "module example.com/app\n\nrequire example.com/dep v1.0.0\n",
+		"app/go.sum":                          "example.com/dep v1.0.0 h1:x=\n",
+		"app/local/local.go":                  "package local",
+		"cache/example.com/dep@v1.0.0/dep.go": "package dependency",
+	})
+	t.Setenv("GO111MODULE", "")
+	t.Setenv("GOMODCACHE", filepath.Join(root, "cache"))
+	t.Setenv("GOWORK", "off")
+	ctx := build.Default
+	defer func(c *build.Context) { Context = c }(Context)
+	Context = &ctx
+	app := filepath.Join(root, "app")
+	file := filepath.Join(root, "imports.json")
+	stamp := Stamp(Context, app)
+	cache, err := OpenImportCache(file, stamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, name := range map[string]string{"example.com/dep": "dependency", "example.com/app/local": "local"} {
+		imp := &ast.ImportSpec{Path: &ast.BasicLit{Value: strconv.Quote(path)}}
+		if actual := cache.GetNameOrGuessFrom(imp, app); actual != name {
+			t.Errorf("name of %s is %s != %s", path, actual, name)
+		}
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = OpenImportCache(file, stamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := cache.Get(app, "example.com/dep"); !ok || name != "dependency" {
+		t.Errorf("name of the package in the module cache is not saved: %v", cache.imports)
+	}
+	// the user may rename the packages of the module itself
+	if _, ok := cache.Get(app, "example.com/app/local"); ok {
+		t.Errorf("name of a package of the main module is saved: %v", cache.imports)
+	}
+	// saved packages are not looked up again, so their name is not guessed without the module cache
+	if err := os.RemoveAll(filepath.Join(root, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	imp := &ast.ImportSpec{Path: &ast.BasicLit{Value: `"example.com/dep"`}}
+	if actual := cache.GetNameOrGuessFrom(imp, app); actual != "dependency" {
+		t.Errorf("saved name of example.com/dep is not used: %s", actual)
+	}
+	writeFiles(t, root, map[string]string{"app/go.sum": "example.com/dep v1.0.0 h1:y=\n"})
+	if Stamp(Context, app) == stamp {
+		t.Fatal("stamp does not change with go.sum")
+	}
+	cache, err = OpenImportCache(file, Stamp(Context, app))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(app, "example.com/dep"); ok {
+		t.Errorf("cache is not invalidated by go.sum: %v", cache.imports)
+	}
+}
+
+func TestImportCacheConcurrent(t *testing.T) {
+	cache := NewImportCache()
+	imp := &ast.ImportSpec{Path: &ast.BasicLit{Value: `"github.com/elazarl/gosloppy/patch"`}}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if name := cache.GetNameOrGuessFrom(imp, "."); name != "patch" {
+					t.Errorf("name of %s evaluated %s != patch", imp.Path.Value, name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(cache.imports) != 1 {
+		t.Errorf("expected the patch package alone to be cached: %v", cache.imports)
+	}
+}
@@ -3,43 +3,165 @@ package imports
 import (
 	"go/ast"
 	"go/build"
-	"log"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
-type ImportCache map[string]string
+// Context is the build context imported packages are looked up in
+var Context = &build.Default
+
+// Getenv returns the environment variables of the go tool, such as GO111MODULE and GOWORK, which
+// decide where imported packages are looked up.
+var Getenv = os.Getenv
+
+// DefaultImportCache is the cache of GetNameOrGuess and GetNameOrGuessFrom.
+var DefaultImportCache = NewImportCache()
 
 // will get the package name, or guess it if absent
-func (cache ImportCache) GetNameOrGuess(imp *ast.ImportSpec) string {
-	if imp.Name != nil {
-		return imp.Name.Name
+func GetNameOrGuess(imp *ast.ImportSpec) string {
+	return DefaultImportCache.GetNameOrGuess(imp)
+}
+
+// GetNameOrGuessFrom is like ImportCache.GetNameOrGuessFrom, with DefaultImportCache.
+func GetNameOrGuessFrom(imp *ast.ImportSpec, srcdir string) string {
+	return DefaultImportCache.GetNameOrGuessFrom(imp, srcdir)
+}
+
+// importPath returns the unquoted path of imp.
+func importPath(imp *ast.ImportSpec) string {
+	if path, err := strconv.Unquote(imp.Path.Value); err == nil {
+		return path
 	}
-	if rv, ok := cache[imp.Path.Value]; ok {
-		return rv
+	return strings.Trim(imp.Path.Value, "`\"")
+}
+
+// getNameOrGuess resolves the name of the package imp imports from srcdir without any cache.
+func getNameOrGuess(imp *ast.ImportSpec, srcdir string) string {
+	path := importPath(imp)
+	if dir := resolveDir(Context, path, srcdir); dir != "" {
+		return packageName(Context, path, dir)
 	}
-	rv := getNameOrGuess(imp)
-	cache[imp.Path.Value] = rv
-	return rv
+	return GuessName(path)
 }
 
-func GetNameOrGuess(imp *ast.ImportSpec) string {
-	return DefaultImportCache.GetNameOrGuess(imp)
+// resolveDir returns the directory of the package path imported from srcdir, or "" if it cannot be
+// found without downloading it. In module mode packages are looked up in the modules of the
+// workspace, as go.work tells, then in the main module, its vendor directory and the module
+// cache, as go.mod tells, and in GOPATH otherwise.
+func resolveDir(ctx *build.Context, path, srcdir string) string {
+	if abs, err := filepath.Abs(srcdir); err == nil {
+		srcdir = abs
+	}
+	if goroot := filepath.Join(ctx.GOROOT, "src", filepath.FromSlash(path)); ctx.GOROOT != "" &&
+		!strings.Contains(strings.SplitN(path, "/", 2)[0], ".") && isDir(ctx, goroot) {
+		return goroot
+	}
+	if Getenv("GO111MODULE") != "off" {
+		if dir := workPackageDir(ctx, path, srcdir); dir != "" {
+			return dir
+		}
+		if m := findModInfo(ctx, srcdir); m != nil {
+			return m.packageDir(ctx, path)
+		}
+	}
+	pkg, err := offlineContext(ctx).Import(path, srcdir, build.FindOnly)
+	if err != nil {
+		return ""
+	}
+	return pkg.Dir
 }
 
-func getNameOrGuess(imp *ast.ImportSpec) string {
-	// remove quotes
-	path := imp.Path.Value[1 : len(imp.Path.Value)-1]
-	pkg, err := build.Import(path, ".", build.AllowBinary)
+// packageName returns the name of the package path in dir, read from its package clauses, or
+// guessed from path if dir has no Go files.
+func packageName(ctx *build.Context, path, dir string) string {
+	if pkg, _ := offlineContext(ctx).ImportDir(dir, 0); pkg != nil && pkg.Name != "" {
+		return pkg.Name
+	}
+	return GuessName(path)
+}
+
+// offlineContext returns ctx customized so that go/build finds packages itself, rather than with go
+// list, which may download modules.
+func offlineContext(ctx *build.Context) *build.Context {
+	offline := *ctx
+	if offline.IsDir == nil {
+		offline.IsDir = func(dir string) bool { return isDir(ctx, dir) }
+	}
+	return &offline
+}
+
+// GuessName guesses the name of the package path from its last element, as packages are usually
+// named, after dropping a major version suffix such as /v2, and a go- prefix, and cutting it at the
+// first character that is not allowed in an identifier. So the name of gopkg.in/yaml.v3 is guessed
+// to be yaml, and the name of github.com/foo/go-bar/v2 bar.
+func GuessName(path string) string {
+	base := pathpkg.Base(path)
+	if isMajorVersion(base) {
+		if dir := pathpkg.Dir(path); dir != "." {
+			base = pathpkg.Base(dir)
+		}
+	}
+	base = strings.TrimPrefix(base, "go-")
+	if i := strings.IndexFunc(base, func(r rune) bool {
+		return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}); i >= 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// isMajorVersion reports whether the path element is a major version suffix, such as v2.
+func isMajorVersion(elem string) bool {
+	if len(elem) < 2 || elem[0] != 'v' {
+		return false
+	}
+	for _, r := range elem[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDir reports whether dir is a directory, as seen by ctx.
+func isDir(ctx *build.Context, dir string) bool {
+	if ctx.IsDir != nil {
+		return ctx.IsDir(dir)
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// fileExists reports whether the file exists, as seen by ctx.
+func fileExists(ctx *build.Context, file string) bool {
+	if ctx.OpenFile == nil {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+	r, err := ctx.OpenFile(file)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// readFile reads the file as seen by ctx.
+func readFile(ctx *build.Context, name string) ([]byte, error) {
+	if ctx.OpenFile == nil {
+		return ioutil.ReadFile(name)
+	}
+	r, err := ctx.OpenFile(name)
 	if err != nil {
-		parts := strings.Split(path, "/")
-		rv := parts[len(parts)-1]
-		// I don't want to fail if I can't find the package
-		// maybe the user is smarter than me, so I guess it's name
-		// TODO(elazar): This shouldn't be in general library
-		log.Println("Cannot find package", path, "guessing it's name is", rv)
-		return rv
+		return nil, err
 	}
-	return pkg.Name
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
 /*
@@ -61,8 +183,6 @@ for k, v in d.iteritems():
 print "}"')
 */
 // all stdlib precached, from rev 5b76706b55af (probably Go 1.1)
-var DefaultImportCache = ImportCache(Stdlib)
-
 var Stdlib = map[string]string{
 	`"archive/tar"`:         "tar",
 	`"archive/zip"`:         "zip",
@@ -2,15 +2,109 @@ package imports
 
 import (
 	"go/ast"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
 // TODO(elazar): test subpackages fetching and cache
 func TestGetPackageName(t *testing.T) {
-	for pkg, name := range DefaultImportCache {
-		actual := getNameOrGuess(&ast.ImportSpec{Path: &ast.BasicLit{Value: pkg}})
+	for pkg, name := range Stdlib {
+		actual := getNameOrGuess(&ast.ImportSpec{Path: &ast.BasicLit{Value: pkg}}, ".")
 		if actual != name {
 			t.Fatalf("standard package %s name evaluated %s != %s", pkg, actual, name)
 		}
 	}
 }
+
+func TestGuessName(t *testing.T) {
+	for path, name := range map[string]string{
+		"fmt":                      "fmt",
+		"gopkg.in/yaml.v3":         "yaml",
+		"github.com/foo/go-bar":    "bar",
+		"github.com/foo/bar/v2":    "bar",
+		"github.com/foo/go-bar/v3": "bar",
+		"example.com/a-b":          "a",
+	} {
+		if actual := GuessName(path); actual != name {
+			t.Errorf("guessed name of %s is %s != %s", path, actual, name)
+		}
+	}
+}
+
+// writeFiles writes the files, by their slash separated names, below dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetNameFromModules(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"app/go.mod": "module example.com/app\n\nrequire (\n\tgopkg.in/yaml.v3 v3.0.1\n" +
+			"\tgithub.com/Foo/go-bar v1.2.0 // indirect\n\texample.com/local v0.0.0\n)\n\n" +
+			"replace example.com/local => ../local\n",
+		"app/cmd/main.go":                               "package main",
+		"app/internal/util/util.go":                     "package utilities",
+		"local/sub/sub.go":                              "package localsub",
+		"cache/gopkg.in/yaml.v3@v3.0.1/yaml.go":         "package yaml",
+		"cache/github.com/!foo/go-bar@v1.2.0/bar.go":    "package barimpl",
+		"cache/github.com/!foo/go-bar@v1.2.0/v2/bar.go": "package barv2",
+		"gopath/src/example.com/gp/gp.go":               "package gopathpkg",
+		"gopath/src/example.com/gp/vendor/x.com/y/y.go": "package vendored",
+		"gopath/src/example.com/gp/cmd/main.go":         "package main",
+		"ws/go.work":                                    "go 1.22\n\nuse (\n\t./a\n\t\"./b\"\n)\n",
+		"ws/a/go.mod":                                   "module example.com/a\n\nrequire gopkg.in/yaml.v3 v3.0.1\n",
+		"ws/a/main.go":                                  "package main",
+		"ws/b/go.mod":                                   "module example.com/b\n",
+		"ws/b/lib/lib.go":                               "package blib",
+	})
+	t.Setenv("GO111MODULE", "")
+	t.Setenv("GOWORK", "")
+	t.Setenv("GOMODCACHE", filepath.Join(root, "cache"))
+	ctx := build.Default
+	ctx.GOPATH = filepath.Join(root, "gopath")
+	defer func(c *build.Context) { Context = c }(Context)
+	Context = &ctx
+	cases := []struct {
+		srcdir string
+		path   string
+		name   string
+	}{
+		{"app/cmd", "example.com/app/internal/util", "utilities"},
+		{"app/cmd", "gopkg.in/yaml.v3", "yaml"},
+		{"app/cmd", "github.com/Foo/go-bar", "barimpl"},
+		{"app/cmd", "github.com/Foo/go-bar/v2", "barv2"},
+		{"app/cmd", "example.com/local/sub", "localsub"},
+		// packages missing from the module cache are guessed
+		{"app/cmd", "example.com/missing/go-thing", "thing"},
+		// modules of the workspace are found without requiring them, and requirements still are
+		{"ws/a", "example.com/b/lib", "blib"},
+		{"ws/a", "gopkg.in/yaml.v3", "yaml"},
+		{"gopath/src/example.com/gp/cmd", "example.com/gp", "gopathpkg"},
+		{"gopath/src/example.com/gp/cmd", "x.com/y", "vendored"},
+		{"gopath/src/example.com/gp/cmd", "fmt", "fmt"},
+	}
+	cache := NewImportCache()
+	for _, c := range cases {
+		imp := &ast.ImportSpec{Path: &ast.BasicLit{Value: strconv.Quote(c.path)}}
+		srcdir := filepath.Join(root, filepath.FromSlash(c.srcdir))
+		if actual := cache.GetNameOrGuessFrom(imp, srcdir); actual != c.name {
+			t.Errorf("name of %s imported from %s is %s != %s", c.path, c.srcdir, actual, c.name)
+		}
+	}
+	// names are cached by the directory of the importing file and the import path
+	if name, ok := cache.Get(filepath.Join(root, "app", "cmd"), "gopkg.in/yaml.v3"); !ok || name != "yaml" {
+		t.Errorf("name of yaml.v3 is not cached by the importing directory: %v", cache.imports)
+	}
+}
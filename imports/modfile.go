@@ -0,0 +1,126 @@
+package imports
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Directive is a single directive of a go.mod or go.work file, with blocks expanded, so that
+// use ( a b ) gives the directives "use a" and "use b".
+type Directive struct {
+	Verb string
+	// Args are the fields following the verb, unquoted
+	Args []string
+	// Line is the directive as written in the file, without the verb
+	Line string
+}
+
+// ParseDirectives parses the directives of a go.mod or go.work file. Malformed lines are skipped,
+// and the error tells of the first of them.
+func ParseDirectives(data []byte) ([]Directive, error) {
+	var directives []Directive
+	var first error
+	block := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields, err := Fields(line)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("line %d: %v", n, err)
+			}
+			continue
+		}
+		switch {
+		case block != "" && line == ")":
+			block = ""
+		case block != "":
+			directives = append(directives, Directive{block, fields, line})
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+		default:
+			directives = append(directives, Directive{fields[0], fields[1:], strings.TrimSpace(line[len(fields[0]):])})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return directives, err
+	}
+	if block != "" && first == nil {
+		first = errors.New("unterminated " + block + " block")
+	}
+	return directives, first
+}
+
+// Fields splits a line of a go.mod file into its fields, unquoting quoted ones.
+func Fields(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' && line[0] != '`' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, err
+		}
+		field, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		line = line[len(quoted):]
+	}
+	return fields, nil
+}
+
+// IsLocalPath reports whether path, the target of a replace directive, is a directory rather
+// than a module path.
+func IsLocalPath(path string) bool {
+	return path == "." || path == ".." || strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") ||
+		filepath.IsAbs(path)
+}
+
+// FindUp returns the file named name in dir or the closest of its parents, or "" if none has it.
+func FindUp(dir, name string) string {
+	for {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return filepath.Join(dir, name)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// FindWork returns the go.work file of the workspace dir is in, if any. As with the go tool, GOWORK
+// names it, or turns workspaces off.
+func FindWork(dir string) string {
+	switch work := Getenv("GOWORK"); work {
+	case "off":
+		return ""
+	case "":
+		return FindUp(dir, "go.work")
+	default:
+		return work
+	}
+}
@@ -0,0 +1,33 @@
+package imports
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseDirectives(t *testing.T) {
+	directives, err := ParseDirectives([]byte(`go 1.22 // comment
+
+use (
+	./a
+	"./b c"
+)
+replace x.com/y v1.0.0 => ../y
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, d := range directives {
+		s = append(s, fmt.Sprintf("%s%q", d.Verb, d.Args))
+	}
+	expected := `[go["1.22"] use["./a"] use["./b c"] replace["x.com/y" "v1.0.0" "=>" "../y"]]`
+	if fmt.Sprint(s) != expected {
+		t.Errorf("Expected %s got %s", expected, s)
+	}
+	// malformed lines are skipped, the error tells of them
+	directives, err = ParseDirectives([]byte("module \"example.com/m\nrequire x.com/y v1.0.0\n"))
+	if err == nil || len(directives) != 1 || directives[0].Verb != "require" {
+		t.Errorf("Expected the require directive alone and an error, got %v %v", directives, err)
+	}
+}
@@ -0,0 +1,258 @@
+package imports
+
+import (
+	"bytes"
+	"go/build"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// modRequirement is a module version a go.mod requires.
+type modRequirement struct {
+	path    string
+	version string
+}
+
+// modReplace is a replace directive of a go.mod, replacing a module, or a single version of it when
+// oldVersion is set, with another module version or with the directory dir.
+type modReplace struct {
+	old        string
+	oldVersion string
+	new        string
+	newVersion string
+	dir        string
+}
+
+// modInfo is what resolving imports needs of a go.mod file.
+type modInfo struct {
+	path     string
+	dir      string
+	requires []modRequirement
+	replaces []modReplace
+}
+
+var (
+	modInfosMu sync.Mutex
+	// modInfos are the go.mod files read, by the directories they were looked up from, nil for
+	// directories in no module
+	modInfos = map[string]*modInfo{}
+)
+
+// findModInfo returns the go.mod of the module dir is in, or nil if it is in none.
+func findModInfo(ctx *build.Context, dir string) *modInfo {
+	modInfosMu.Lock()
+	defer modInfosMu.Unlock()
+	var visited []string
+	var m *modInfo
+	for {
+		if cached, ok := modInfos[dir]; ok {
+			m = cached
+			break
+		}
+		visited = append(visited, dir)
+		if data, err := readFile(ctx, filepath.Join(dir, "go.mod")); err == nil {
+			m = parseModInfo(data, dir)
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for _, dir := range visited {
+		modInfos[dir] = m
+	}
+	return m
+}
+
+// parseModInfo parses the module, require and replace directives of the go.mod in dir. Malformed
+// lines are skipped, the go tool reports them when building.
+func parseModInfo(data []byte, dir string) *modInfo {
+	m := &modInfo{"", dir, nil, nil}
+	directives, _ := ParseDirectives(data)
+	for _, d := range directives {
+		switch {
+		case d.Verb == "module" && len(d.Args) == 1:
+			m.path = d.Args[0]
+		case d.Verb == "require" && len(d.Args) >= 2:
+			m.requires = append(m.requires, modRequirement{d.Args[0], d.Args[1]})
+		case d.Verb == "replace":
+			if r, ok := parseReplace(d.Args, dir); ok {
+				m.replaces = append(m.replaces, r)
+			}
+		}
+	}
+	if m.path == "" {
+		return nil
+	}
+	return m
+}
+
+// parseReplace parses the arguments of a replace directive, "old [version] => new [version]", of
+// the go.mod in dir.
+func parseReplace(args []string, dir string) (modReplace, bool) {
+	arrow := -1
+	for i, arg := range args {
+		if arg == "=>" {
+			arrow = i
+		}
+	}
+	if arrow != 1 && arrow != 2 || arrow+1 >= len(args) {
+		return modReplace{}, false
+	}
+	r := modReplace{args[0], "", "", "", ""}
+	if arrow == 2 {
+		r.oldVersion = args[1]
+	}
+	switch target := args[arrow+1:]; {
+	case IsLocalPath(target[0]):
+		r.dir = filepath.FromSlash(target[0])
+		if !filepath.IsAbs(r.dir) {
+			r.dir = filepath.Join(dir, r.dir)
+		}
+	case len(target) == 2:
+		r.new, r.newVersion = target[0], target[1]
+	default:
+		return modReplace{}, false
+	}
+	return r, true
+}
+
+var (
+	workModsMu sync.Mutex
+	// workMods are the modules of the go.work files read, by file
+	workMods = map[string][]*modInfo{}
+)
+
+// workModules returns the modules the go.work file uses, those whose go.mod cannot be read left
+// out.
+func workModules(ctx *build.Context, file string) []*modInfo {
+	workModsMu.Lock()
+	defer workModsMu.Unlock()
+	if mods, ok := workMods[file]; ok {
+		return mods
+	}
+	var mods []*modInfo
+	if data, err := readFile(ctx, file); err == nil {
+		directives, _ := ParseDirectives(data)
+		for _, d := range directives {
+			if d.Verb != "use" || len(d.Args) != 1 {
+				continue
+			}
+			dir := filepath.FromSlash(d.Args[0])
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(file), dir)
+			}
+			if data, err := readFile(ctx, filepath.Join(dir, "go.mod")); err == nil {
+				if m := parseModInfo(data, dir); m != nil {
+					mods = append(mods, m)
+				}
+			}
+		}
+	}
+	workMods[file] = mods
+	return mods
+}
+
+// workPackageDir returns the directory of the package path in the module of the workspace srcdir
+// is in which provides it, or "" if srcdir is in no workspace, or no module of it provides path.
+func workPackageDir(ctx *build.Context, path, srcdir string) string {
+	file := FindWork(srcdir)
+	if file == "" {
+		return ""
+	}
+	var mod *modInfo
+	for _, m := range workModules(ctx, file) {
+		if hasPathPrefix(path, m.path) && (mod == nil || len(m.path) > len(mod.path)) {
+			mod = m
+		}
+	}
+	if mod == nil {
+		return ""
+	}
+	return filepath.Join(mod.dir, filepath.FromSlash(strings.TrimPrefix(path[len(mod.path):], "/")))
+}
+
+// packageDir returns the directory of the package path imported from the module m: a package of the
+// module itself, of its vendor directory, or of a module it requires, in the module cache or in
+// the directory it is replaced with. It returns "" for packages of no module m knows of, as the go
+// tool would have to download them.
+func (m *modInfo) packageDir(ctx *build.Context, path string) string {
+	if vendored := filepath.Join(m.dir, "vendor", filepath.FromSlash(path)); isDir(ctx, vendored) &&
+		fileExists(ctx, filepath.Join(m.dir, "vendor", "modules.txt")) {
+		return vendored
+	}
+	// the module providing the package is the one with the longest path prefixing it
+	mod := modRequirement{}
+	if hasPathPrefix(path, m.path) {
+		mod.path = m.path
+	}
+	for _, req := range m.requires {
+		if hasPathPrefix(path, req.path) && len(req.path) > len(mod.path) {
+			mod = req
+		}
+	}
+	if mod.path == "" {
+		return ""
+	}
+	rest := filepath.FromSlash(strings.TrimPrefix(path[len(mod.path):], "/"))
+	if mod.path == m.path {
+		return filepath.Join(m.dir, rest)
+	}
+	var replace *modReplace
+	for i, r := range m.replaces {
+		if r.old == mod.path && (r.oldVersion == mod.version || r.oldVersion == "" && replace == nil) {
+			replace = &m.replaces[i]
+		}
+	}
+	switch {
+	case replace == nil:
+		return filepath.Join(modCacheDir(ctx, mod.path, mod.version), rest)
+	case replace.dir != "":
+		return filepath.Join(replace.dir, rest)
+	}
+	return filepath.Join(modCacheDir(ctx, replace.new, replace.newVersion), rest)
+}
+
+// hasPathPrefix reports whether path is the import path prefix, or below it.
+func hasPathPrefix(path, prefix string) bool {
+	return prefix != "" && (path == prefix || strings.HasPrefix(path, prefix+"/"))
+}
+
+// modCacheRoot returns the module cache, which is GOMODCACHE, or pkg/mod in the first GOPATH entry.
+func modCacheRoot(ctx *build.Context) string {
+	if cache := Getenv("GOMODCACHE"); cache != "" {
+		return cache
+	}
+	gopath := filepath.SplitList(ctx.GOPATH)
+	if len(gopath) == 0 {
+		return ""
+	}
+	return filepath.Join(gopath[0], "pkg", "mod")
+}
+
+// modCacheDir returns the directory of the module version in the module cache.
+func modCacheDir(ctx *build.Context, path, version string) string {
+	cache := modCacheRoot(ctx)
+	if cache == "" {
+		return ""
+	}
+	return filepath.Join(cache, filepath.FromSlash(escapeModPath(path)+"@"+escapeModPath(version)))
+}
+
+// escapeModPath escapes the module path or version as the module cache does, every upper case
+// letter written as "!" followed by the letter in lower case, for case insensitive file systems.
+func escapeModPath(s string) string {
+	buf := new(bytes.Buffer)
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			buf.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,133 @@
+package instrument
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Assets returns the files other than .go files that building the package needs, relative to
+// the package directory: assembly, cgo, swig and syso files, and the files matched by its
+// //go:embed patterns. withtests adds the embeds of the tests, and the testdata directory.
+func (i *Instrumentable) Assets(withtests bool) ([]string, error) {
+	pkg := i.pkg
+	if pkg.Dir == "" {
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	var assets []string
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			assets = append(assets, file)
+		}
+	}
+	for _, files := range [][]string{pkg.SFiles, pkg.CFiles, pkg.CXXFiles, pkg.MFiles, pkg.HFiles,
+		pkg.FFiles, pkg.SwigFiles, pkg.SwigCXXFiles, pkg.SysoFiles} {
+		for _, file := range files {
+			add(file)
+		}
+	}
+	patterns := pkg.EmbedPatterns
+	if withtests {
+		patterns = append(append(append([]string{}, patterns...), pkg.TestEmbedPatterns...), pkg.XTestEmbedPatterns...)
+		if info, err := os.Stat(filepath.Join(pkg.Dir, "testdata")); err == nil && info.IsDir() {
+			if err := walkAssets(pkg.Dir, "testdata", true, add); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		if err := resolveEmbed(pkg.Dir, pattern, add); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(assets)
+	return assets, nil
+}
+
+// resolveEmbed calls add with every file matched by the //go:embed pattern, relative to dir.
+// As with the go tool, files in matched directories starting with "." or "_" are left out,
+// unless the pattern starts with "all:". Patterns matching nothing are left for the go tool
+// to report.
+func resolveEmbed(dir, pattern string, add func(file string)) error {
+	all := strings.HasPrefix(pattern, "all:")
+	pattern = strings.TrimPrefix(pattern, "all:")
+	matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		rel, err := filepath.Rel(dir, match)
+		if err != nil {
+			return err
+		}
+		if err := walkAssets(dir, rel, all, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkAssets calls add with rel, if it is a file, or with the files below it, if it is a directory.
+func walkAssets(dir, rel string, all bool, add func(file string)) error {
+	root := filepath.Join(dir, rel)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if path != root && !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil && path != root {
+				// embedding never crosses into another module
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		file, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		add(file)
+		return nil
+	})
+}
+
+// linkOrCopy makes dst a hard link to src, or a copy of it if linking is not possible, e.g.
+// when the temporary directory is on another device. Symbolic links are not used, since
+// the go tool refuses to embed them.
+func linkOrCopy(src, dst string) error {
+	// never write through an existing link to the original file
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	info, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,44 @@
+package instrument
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestAssets(t *testing.T) {
+	fs := dir(
+		"test",
+		file("a.go", "package a\nimport \"embed\"\n//go:embed static *.txt\nvar fs embed.FS\n"),
+		file("a_test.go", "package a\nimport _ \"embed\"\n//go:embed testdata/in\nvar s string\n"),
+		file("a_amd64.s", ""),
+		file("b.txt", "b"),
+		file("c.syso", ""),
+		dir("static", file("x", "x"), file(".hidden", ""), dir("_skip", file("y", ""))),
+		dir("testdata", file("in", "in"), file("other", "")),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	pkg, err := ImportDir("", "test")
+	OrFail(err, t)
+	assets, err := pkg.Assets(false)
+	OrFail(err, t)
+	expectEq("[a_amd64.s b.txt c.syso static/x]", fmt.Sprint(assets), t)
+	assets, err = pkg.Assets(true)
+	OrFail(err, t)
+	expectEq("[a_amd64.s b.txt c.syso static/x testdata/in testdata/other]", fmt.Sprint(assets), t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	OrFail(pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, nil
+	}), t)
+	dir("temp", localsDir(t, "test",
+		file("a.go", "package a\nimport \"embed\"\n//go:embed static *.txt\nvar fs embed.FS\n"),
+		file("a_amd64.s", ""),
+		file("b.txt", "b"),
+		file("c.syso", ""),
+		dir("static", file("x", "x")),
+	)).AssertEqual("temp", t)
+}
@@ -0,0 +1,110 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+
+	"github.com/elazarl/gosloppy/imports"
+)
+
+// PrefixesEnv is the environment variable listing, separated by commas, the import path prefixes
+// of the packages to instrument together, such as the packages of an organization.
+const PrefixesEnv = "GOSLOPPYPREFIXES"
+
+// guessBasepkg returns the base package of the package importpath in dir, the packages below which
+// are instrumented with it, and why it is the base package. In order, the base package is
+//   - the longest prefix of importpath listed in GOSLOPPYPREFIXES
+//   - the common path of the modules of the go.work of dir, or "*" if they have none
+//   - the path of the module of dir
+//
+// and, as a last resort, the farthest parent of importpath all parents up to which are directories
+// of GOPATH, short of its host name.
+func guessBasepkg(ctx *build.Context, importpath, dir string) (basepkg, why string) {
+	if prefix := configuredPrefix(imports.Getenv(PrefixesEnv), importpath); prefix != "" {
+		return prefix, fmt.Sprintf("%s lists the prefix %s", PrefixesEnv, prefix)
+	}
+	if dir != "" {
+		if m := moduleOfDir(dir); m != nil && hasPathPrefix(importpath, m.Path) {
+			if w := workspaceOfDir(dir); w != nil && w.ModuleOf(dir) != nil {
+				switch common := commonPath(w.Modules); {
+				case common == "":
+					return "*", "the modules of " + w.File + " share no path, all of them are instrumented"
+				case common != m.Path:
+					return common, "the modules of " + w.File + " are all below it"
+				}
+			}
+			return m.Path, "it is the path of the module in " + m.Dir
+		}
+	}
+	p := importpath
+	for strings.Contains(p, "/") {
+		parent := filepath.Dir(p)
+		if !strings.Contains(parent, "/") && strings.Contains(parent, ".") {
+			return p, fmt.Sprintf("no module contains %s, and its parent %s is a host name", importpath, parent)
+		}
+		// a repository root may have no .go files of its own
+		if _, err := ctx.Import(parent, "", build.FindOnly); err != nil {
+			return p, fmt.Sprintf("no module contains %s, and its parent %s is not in GOPATH", importpath, parent)
+		}
+		p = parent
+	}
+	return p, fmt.Sprintf("no module contains %s, and all its parents are in GOPATH", importpath)
+}
+
+// configuredPrefix returns the longest of the comma separated prefixes importpath is in, if any.
+func configuredPrefix(prefixes, importpath string) string {
+	best := ""
+	for _, prefix := range strings.Split(prefixes, ",") {
+		prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "/")
+		if prefix != "" && hasPathPrefix(importpath, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	return best
+}
+
+// moduleOfDir returns the module whose go.mod is in dir or in the closest of its parents.
+func moduleOfDir(dir string) *Module {
+	file := imports.FindUp(dir, "go.mod")
+	if file == "" {
+		return nil
+	}
+	m, err := readModule(filepath.Dir(file))
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// workspaceOfDir returns the workspace of the go.work of dir, as the go tool would find it.
+func workspaceOfDir(dir string) *Workspace {
+	file := imports.FindWork(dir)
+	if file == "" {
+		return nil
+	}
+	w, err := readWorkspace(file)
+	if err != nil {
+		return nil
+	}
+	return w
+}
+
+// commonPath returns the longest import path all modules are below, "" if they share none.
+func commonPath(modules []*Module) string {
+	if len(modules) == 0 {
+		return ""
+	}
+	common := modules[0].Path
+	for _, m := range modules[1:] {
+		for !hasPathPrefix(m.Path, common) {
+			i := strings.LastIndex(common, "/")
+			if i < 0 {
+				return ""
+			}
+			common = common[:i]
+		}
+	}
+	return common
+}
@@ -0,0 +1,102 @@
+package instrument
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfiguredPrefix(t *testing.T) {
+	for _, c := range []struct{ prefixes, importpath, expected string }{
+		{"", "example.com/a", ""},
+		{"example.com", "example.com/a/b", "example.com"},
+		{"example.com, example.com/a/", "example.com/a/b", "example.com/a"},
+		{"example.com/a", "example.com/ab", ""},
+		{"example.com/a,,", "example.com/a", "example.com/a"},
+	} {
+		expectEq(c.expected, configuredPrefix(c.prefixes, c.importpath), t)
+	}
+}
+
+func TestCommonPath(t *testing.T) {
+	modules := func(paths ...string) (ms []*Module) {
+		for _, path := range paths {
+			ms = append(ms, &Module{path, "", ""})
+		}
+		return ms
+	}
+	expectEq("", commonPath(nil), t)
+	expectEq("example.com/a", commonPath(modules("example.com/a")), t)
+	expectEq("example.com/org", commonPath(modules("example.com/org/a", "example.com/org/b/c")), t)
+	expectEq("", commonPath(modules("example.com/a", "example.org/b")), t)
+	expectEq("example.com/a", commonPath(modules("example.com/a", "example.com/a/b")), t)
+}
+
+func TestGuessBasepkg(t *testing.T) {
+	fs := dir(
+		"basepkg",
+		dir("mod", file("go.mod", "module example.com/org/mod\n"),
+			dir("sub", file("sub.go", "package sub"))),
+		dir("ws", file("go.work", "go 1.21\n\nuse (\n\t./a\n\t./b\n)\n"),
+			dir("a", file("go.mod", "module example.com/org/a\n"), file("a.go", "package a")),
+			dir("b", file("go.mod", "module example.com/org/b\n"), file("b.go", "package b"))),
+		dir("ws2", file("go.work", "go 1.21\n\nuse (\n\t./a\n\t./b\n)\n"),
+			dir("a", file("go.mod", "module example.com/a\n"), file("a.go", "package a")),
+			dir("b", file("go.mod", "module example.org/b\n"), file("b.go", "package b"))),
+		dir("gopath", dir("src",
+			dir("x.org",
+				dir("repo", file("repo.go", "package repo"), dir("sub", file("sub.go", "package sub"))),
+				dir("norepo", dir("sub", file("sub.go", "package sub")))),
+			dir("a", dir("b", file("b.go", "package b"))),
+		)),
+	)
+	OrFail(fs.Build("."), t)
+	root, err := filepath.Abs("basepkg")
+	OrFail(err, t)
+	defer func() { OrFail(os.RemoveAll(root), t) }()
+	ctx := build.Default
+	ctx.GOPATH = filepath.Join(root, "gopath")
+	t.Setenv("GOWORK", "")
+	t.Setenv(PrefixesEnv, "")
+	for _, c := range []struct {
+		importpath, dir, prefixes string
+		basepkg, why              string
+	}{
+		{"example.com/org/mod/sub", "mod/sub", "", "example.com/org/mod", "module"},
+		{"example.com/org/mod/sub", "mod/sub", "example.com", "example.com", PrefixesEnv},
+		{"example.com/org/a", "ws/a", "", "example.com/org", "go.work"},
+		{"example.com/a", "ws2/a", "", "*", "share no path"},
+		{"x.org/repo/sub", "gopath/src/x.org/repo/sub", "", "x.org/repo", "x.org is a host name"},
+		// a repository root without .go files
+		{"x.org/norepo/sub", "gopath/src/x.org/norepo/sub", "", "x.org/norepo", "x.org is a host name"},
+		{"a/b", "gopath/src/a/b", "", "a", "all its parents are in GOPATH"},
+	} {
+		t.Setenv(PrefixesEnv, c.prefixes)
+		basepkg, why := guessBasepkg(&ctx, c.importpath, filepath.Join(root, filepath.FromSlash(c.dir)))
+		expectEq(c.basepkg, basepkg, t)
+		if !strings.Contains(why, c.why) {
+			t.Errorf("base package %s of %s is explained by %q, without %q", basepkg, c.importpath, why, c.why)
+		}
+	}
+	// packages imported by their import path, and by their directory in a module, are guessed alike
+	pkg, err := ImportContext(&ctx, "", "x.org/norepo/sub")
+	OrFail(err, t)
+	basepkg, why := pkg.Basepkg()
+	expectEq("x.org/norepo", basepkg, t)
+	t.Setenv("GO111MODULE", "on")
+	t.Chdir(filepath.Join(root, "mod"))
+	for _, pkg := range []func() (*Instrumentable, error){
+		func() (*Instrumentable, error) { return ImportContext(&ctx, "", "example.com/org/mod/sub") },
+		func() (*Instrumentable, error) { return ImportDirContext(&ctx, "", "sub") },
+	} {
+		pkg, err := pkg()
+		OrFail(err, t)
+		basepkg, why = pkg.Basepkg()
+		expectEq("example.com/org/mod", basepkg, t)
+		if !strings.Contains(why, "module") {
+			t.Errorf("base package %s of %s is explained by %q", basepkg, pkg.Package().ImportPath, why)
+		}
+	}
+}
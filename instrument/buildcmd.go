@@ -3,13 +3,15 @@ package instrument
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"go/build"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
-	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/elazarl/gosloppy/patch"
 )
 
 // GoCmd is a serialized command line instruction to run the Go tool
@@ -23,115 +25,274 @@ type GoCmd struct {
 	BuildFlags Flags
 	Params     []string
 	ExtraFlags []string
+	// Overlay has the files of the -overlay flag, which take precedence over the files on disk.
+	// The flag itself is not passed to the go tool, which builds the instrumented files.
+	Overlay patch.Overlay
+	// Env are environment variables set for the go tool, in addition to those of gosloppy.
+	Env []string
+}
+
+// Flag is a single flag given to the go tool.
+type Flag struct {
+	Name  string
+	Value string
+	// NoValue is set for flags unknown to gosloppy given without a value, which are passed as is
+	NoValue bool
+}
+
+// Arg returns the command line argument for the flag.
+func (f Flag) Arg() string {
+	if f.NoValue {
+		return "-" + f.Name
+	}
+	return "-" + f.Name + "=" + f.Value
 }
 
-type Flags map[string]string
+// Flags are the flags given to the go tool, in the order they were given.
+type Flags []Flag
 
 func FromFlagSet(fs *flag.FlagSet) Flags {
-	return make(Flags).FromFlagSet(fs)
+	return Flags{}.FromFlagSet(fs)
 }
 
 func (flags Flags) FromFlagSet(fs *flag.FlagSet) Flags {
 	fs.Visit(func(f *flag.Flag) {
-		flags[f.Name] = f.Value.String()
+		flags.Set(f.Name, f.Value.String())
 	})
 	return flags
 }
 
+// Lookup returns the value of the flag name. As with the flag package, the last occurrence wins.
+func (flags Flags) Lookup(name string) (value string, ok bool) {
+	for _, f := range flags {
+		if f.Name == name {
+			value, ok = f.Value, true
+		}
+	}
+	return
+}
+
+// Get returns the value of the flag name, or "" if it was not given.
+func (flags Flags) Get(name string) string {
+	v, _ := flags.Lookup(name)
+	return v
+}
+
+// Bool reports whether the boolean flag name was given, and not set to false.
+func (flags Flags) Bool(name string) bool {
+	v, ok := flags.Lookup(name)
+	b, err := strconv.ParseBool(v)
+	return ok && (v == "" || err == nil && b)
+}
+
+// Set sets the value of the flag name, keeping its position if it was already given.
+func (flags *Flags) Set(name, value string) {
+	for i, f := range *flags {
+		if f.Name == name {
+			(*flags)[i] = Flag{name, value, false}
+			*flags = append((*flags)[:i+1], (*flags)[i+1:].without(name)...)
+			return
+		}
+	}
+	*flags = append(*flags, Flag{name, value, false})
+}
+
+// Delete removes all occurrences of the flag name.
+func (flags *Flags) Delete(name string) {
+	*flags = flags.without(name)
+}
+
+func (flags Flags) without(name string) Flags {
+	var r Flags
+	for _, f := range flags {
+		if f.Name != name {
+			r = append(r, f)
+		}
+	}
+	return r
+}
+
 func (flags Flags) Clone() Flags {
-	clone := make(Flags)
-	for k, v := range flags {
-		clone[k] = v
+	return append(Flags{}, flags...)
+}
+
+// Args returns the flags as command line arguments.
+func (flags Flags) Args() []string {
+	args := make([]string, len(flags))
+	for i, f := range flags {
+		args[i] = f.Arg()
 	}
-	return clone
+	return args
 }
 
 func (flags Flags) String() string {
-	b := make([]byte, 0, 100)
-	for k, v := range flags {
-		b = append(b, k+"="+v...)
+	l := make([]string, len(flags))
+	for i, f := range flags {
+		l[i] = f.Name + "=" + f.Value
+		if f.NoValue {
+			l[i] = f.Name
+		}
 	}
-	return string(b)
+	return strings.Join(l, " ")
 }
 
 func NewGoCmd(workdir string, args ...string) (*GoCmd, error) {
 	return NewGoCmdWithFlags(flag.NewFlagSet("", flag.ContinueOnError), workdir, args...)
 }
 
+// NewGoCmdWithFlags parses the go tool command line args. Flags defined in flagset are set
+// there, and are not passed to the go tool.
 func NewGoCmdWithFlags(flagset *flag.FlagSet, workdir string, args ...string) (*GoCmd, error) {
 	if len(args) < 2 {
 		return nil, errors.New("GoCmd must have at least two arguments (e.g. go build)")
 	}
-	if sort.SearchStrings([]string{"build", "run", "test"}, args[1]) > -1 {
-		flagset.Int("p", runtime.NumCPU(), "number or parallel builds")
-		for _, f := range []string{"x", "v", "n", "a", "work"} {
-			flagset.Bool(f, false, "")
-		}
-		for _, f := range []string{"compiler", "gccgoflags", "gcflags", "ldflags", "tags"} {
-			flagset.String(f, "", "")
-		}
+	if _, ok := commandFlags[args[1]]; !ok {
+		return nil, errors.New("Currently only build run test and diff commands supported")
 	}
-	switch args[1] {
-	case "run":
-	case "build":
-		flagset.String("o", "", "output: output file")
-	case "test":
-		for _, f := range []string{"i", "c"} {
-			flagset.Bool(f, false, "")
-		}
-		for _, testflag := range []string{
-			"bench",
-			"benchtime",
-			"cpu",
-			"cpuprofile",
-			"memprofile",
-			"memprofilerate",
-			"parallel",
-			"run",
-			"timeout"} {
-			flagset.String(testflag, "", "")
-			flagset.String("test."+testflag, "", "")
-		}
-		flagset.Bool("short", false, "")
-		flagset.Bool("test.short", false, "")
-		flagset.Bool("test.v", false, "")
-	default:
-		return nil, errors.New("Currently only build run and test commands supported")
-	}
-	if err := flagset.Parse(args[2:]); err != nil {
+	flags, rest, err := parseFlags(flagset, args[1], args[2:])
+	if err != nil {
 		return nil, err
 	}
 	var params, extra []string
 	switch args[1] {
-	case "build":
-		params = flagset.Args()
+	case "build", "diff":
+		params = rest
 	case "run":
-		for i, param := range flagset.Args() {
+		for i, param := range rest {
 			if !strings.HasSuffix(param, ".go") {
-				extra = flagset.Args()[i:]
+				extra = rest[i:]
 				break
 			}
 			params = append(params, param)
 		}
 	case "test":
-		for i, param := range flagset.Args() {
+		for i, param := range rest {
 			if strings.HasPrefix(param, "-") {
-				extra = flagset.Args()[i:]
+				extra = rest[i:]
 				break
 			}
 			params = append(params, param)
 		}
-	default:
-		return nil, errors.New("Currently only build run and test commands supported")
 	}
-	return &GoCmd{workdir, args[0], args[1], FromFlagSet(flagset), params, extra}, nil
+	if dir := flags.Get("C"); dir != "" {
+		// as the go tool, change to dir first, the rest of the command line is relative to it. The
+		// go tool runs in the output, and must not change directories again.
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(workdir, dir)
+		}
+		workdir = dir
+		flags.Delete("C")
+	}
+	var overlay patch.Overlay
+	if file := flags.Get("overlay"); file != "" {
+		if overlay, err = ReadOverlay(workdir, file); err != nil {
+			return nil, err
+		}
+		// the instrumented files have the content of the overlay, which the go tool, running in
+		// the output, would resolve relative names of to the instrumented files themselves. It
+		// gets the rest of the overlay, see SourceMap.GoOverlay.
+		flags.Delete("overlay")
+	}
+	return &GoCmd{workdir, args[0], args[1], flags, params, extra, overlay, nil}, nil
+}
+
+// parseFlags parses the flags of the go command at the start of args. Flags defined in flagset
+// are set there, the rest are returned in order. Flags unknown to gosloppy are passed verbatim,
+// and are assumed not to take a value unless given as -flag=value.
+func parseFlags(flagset *flag.FlagSet, command string, args []string) (flags Flags, rest []string, err error) {
+	for len(args) > 0 && isFlag(args[0]) {
+		name, value, hasvalue := splitFlag(args[0])
+		if command == "test" && name == "args" {
+			// the rest is passed to the test binary
+			break
+		}
+		if _, _, known := lookupGoFlag(command, name); command == "test" && !known && flagset.Lookup(name) == nil {
+			// as go test, pass flags it does not know, -name=value or not, and everything after
+			// them, to the test binary, which may define them
+			break
+		}
+		args = args[1:]
+		if f := flagset.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface {
+				IsBoolFlag() bool
+			}); !hasvalue && ok && b.IsBoolFlag() {
+				value, hasvalue = "true", true
+			}
+			if !hasvalue {
+				if len(args) == 0 {
+					return nil, nil, errors.New("flag needs an argument: -" + name)
+				}
+				value, args = args[0], args[1:]
+			}
+			if err := flagset.Set(name, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid value %q for flag -%s: %v", value, name, err)
+			}
+			continue
+		}
+		name, goflag, known := lookupGoFlag(command, name)
+		switch {
+		case hasvalue:
+		case !known:
+			flags = append(flags, Flag{name, "", true})
+			continue
+		case goflag.value:
+			if len(args) == 0 {
+				return nil, nil, errors.New("flag needs an argument: -" + name)
+			}
+			value, args = args[0], args[1:]
+		default:
+			value = "true"
+		}
+		flags = append(flags, Flag{name, value, false})
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+// TestBinaryArgs removes the flags go test passes to the test binary from cmd.BuildFlags, and
+// returns the arguments to run the test binary with, including cmd.ExtraFlags.
+func (cmd *GoCmd) TestBinaryArgs() []string {
+	var args []string
+	var buildflags Flags
+	for _, f := range cmd.BuildFlags {
+		_, goflag, _ := lookupGoFlag("test", f.Name)
+		if goflag.test {
+			args = append(args, Flag{"test." + f.Name, f.Value, f.NoValue}.Arg())
+		}
+		if !goflag.test || goflag.build {
+			buildflags = append(buildflags, f)
+		}
+	}
+	cmd.BuildFlags = buildflags
+	return append(args, testBinaryArgs(cmd.ExtraFlags)...)
+}
+
+// testBinaryArgs adds the "test." prefix to test flags in args, up to -args.
+func testBinaryArgs(args []string) []string {
+	var r []string
+	for i, arg := range args {
+		if arg == "-args" || arg == "--args" {
+			return append(r, args[i+1:]...)
+		}
+		if isFlag(arg) {
+			name, value, hasvalue := splitFlag(arg)
+			if name, goflag, ok := lookupGoFlag("test", name); ok && goflag.test {
+				arg = "-test." + name
+				if hasvalue {
+					arg += "=" + value
+				}
+			}
+		}
+		r = append(r, arg)
+	}
+	return r
 }
 
 func (cmd *GoCmd) Args() []string {
 	l := []string{cmd.Command}
-	for k, v := range cmd.BuildFlags {
-		l = append(l, "-"+k+"="+v)
-	}
+	l = append(l, cmd.BuildFlags.Args()...)
 	l = append(l, cmd.Params...)
 	l = append(l, cmd.ExtraFlags...)
 	return l
@@ -141,62 +302,56 @@ func (cmd *GoCmd) String() string {
 	return strings.Join(append([]string{cmd.Executable}, cmd.Args()...), " ")
 }
 
-func (cmd *GoCmd) OutputFileName() (name string, ismain bool, err error) {
-	if len(cmd.Params) > 1 {
-		return "", false, errors.New("No support for more than a single package:" + strings.Join(cmd.Params, " "))
+// Context returns the build context the go tool uses for cmd: build.Default, which follows
+// GOOS, GOARCH and CGO_ENABLED of the environment, with the build tags given by -tags, and
+// those implied by -race, -msan and -asan.
+func (cmd *GoCmd) Context() *build.Context {
+	ctx := build.Default
+	if tags := cmd.BuildFlags.Get("tags"); tags != "" {
+		// both the current comma separated, and the older space separated, lists are accepted
+		ctx.BuildTags = append(append([]string{}, ctx.BuildTags...), strings.FieldsFunc(tags, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
 	}
-	// TODO(elazar): use previous build.Package, or make build.Package cache. no reason to duplicate code
-	var pkg *build.Package
-	if len(cmd.Params) == 0 {
-		pkg, err = build.ImportDir(cmd.WorkDir, 0)
-	} else {
-		pkg, err = build.Import(cmd.Params[0], "", 0)
-	}
-	if err != nil {
-		return "", false, err
+	for _, tag := range []string{"race", "msan", "asan"} {
+		if cmd.BuildFlags.Bool(tag) {
+			ctx.ToolTags = append(append([]string{}, ctx.ToolTags...), tag)
+		}
 	}
-	if pkg.Name != "main" {
-		return pkg.Name, true, nil
+	if compiler := cmd.BuildFlags.Get("compiler"); compiler != "" {
+		ctx.Compiler = compiler
 	}
-	d, err := filepath.Abs(pkg.Dir)
-	if err != nil {
-		return "", false, err
+	if cmd.Overlay != nil {
+		return OverlayContext(&ctx, cmd.Overlay)
 	}
-	return filepath.Base(d), false, nil
+	return &ctx
 }
 
-// Retarget will return a new command line to compile the new target, but keep paths
-// redirected to the original target.
-func (cmd *GoCmd) Retarget(newdir string) (*GoCmd, error) {
-	workdir, err := filepath.Abs(cmd.WorkDir)
-	if err != nil {
-		return nil, err
+// HasFiles reports whether the command is given a list of .go files, rather than packages.
+func (cmd *GoCmd) HasFiles() bool {
+	for _, param := range cmd.Params {
+		if !strings.HasSuffix(param, ".go") {
+			return false
+		}
 	}
-	buildflags := cmd.BuildFlags.Clone()
-	switch cmd.Command {
-	case "run", "test":
-	case "build":
-		v := cmd.BuildFlags["o"]
-		if v == "" {
-			name, ismain, err := cmd.OutputFileName()
-			if ismain {
-				return nil, errors.New("gosloppy won't build non-main package, just for testing packages or producing executables")
-			}
-			if err != nil {
-				return nil, err
-			}
-			v = name
+	return len(cmd.Params) > 0
+}
+
+// Getenv returns the environment variable key the go tool runs with, set in Env, or else inherited
+// from gosloppy.
+func (cmd *GoCmd) Getenv(key string) string {
+	for i := len(cmd.Env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(cmd.Env[i], key+"=") {
+			return cmd.Env[i][len(key)+1:]
 		}
-		buildflags["o"] = filepath.Join(workdir, v)
-	default:
-		return nil, errors.New("No support for commands other than build test or run")
 	}
-	return &GoCmd{newdir, cmd.Executable, cmd.Command, buildflags, cmd.Params, cmd.ExtraFlags}, nil
+	return os.Getenv(key)
 }
 
 func (cmd *GoCmd) Runnable() *exec.Cmd {
 	r := exec.Command(cmd.Executable, cmd.Args()...)
 	r.Dir = cmd.WorkDir
+	r.Env = append(os.Environ(), cmd.Env...)
 	r.Stdin = os.Stdin
 	r.Stdout = os.Stdout
 	r.Stderr = os.Stderr
@@ -1,6 +1,7 @@
 package instrument
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -19,18 +20,6 @@ func expectEq(exp, act string, t *testing.T) {
 	}
 }
 
-func TestGoCmdRetarget(t *testing.T) {
-	OrFail(dir("pkg", file("p.go", "package main;func main(){}")).Build("."), t)
-	defer func() { OrFail(os.RemoveAll("pkg"), t) }()
-	cmd, err := NewGoCmd("pkg", "go", "build", "-o", "koko")
-	OrFail(err, t)
-	cmd, err = cmd.Retarget("pkg/temp")
-	OrFail(err, t)
-	path, err := filepath.Abs(filepath.Join(cmd.WorkDir, "../koko"))
-	OrFail(err, t)
-	expectEq(fmt.Sprint("go build -o=", path), cmd.String(), t)
-}
-
 func TestGoCmdParsing(t *testing.T) {
 	cmd, err := NewGoCmd(".", "go", "build", "-o", "koko", "bobo")
 	OrFail(err, t)
@@ -69,3 +58,114 @@ func TestGoCmdParsingTestNoPkg(t *testing.T) {
 	expectEq("run=away", fmt.Sprint(cmd.BuildFlags), t)
 	expectEq("test", fmt.Sprint(cmd.Command), t)
 }
+
+func TestGoCmdParsingKeepsOrder(t *testing.T) {
+	cmd, err := NewGoCmd(".", "go", "build", "-race", "-trimpath", "-tags", "a,b", "-x", "-mod=vendor", "-unknown", "bobo")
+	OrFail(err, t)
+	expectEq("[bobo]", fmt.Sprint(cmd.Params), t)
+	expectEq("go build -race=true -trimpath=true -tags=a,b -x=true -mod=vendor -unknown bobo", cmd.String(), t)
+	expectEq("a,b", cmd.BuildFlags.Get("tags"), t)
+	if !cmd.BuildFlags.Bool("race") || !cmd.BuildFlags.Bool("unknown") || cmd.BuildFlags.Bool("a") {
+		t.Error("unexpected boolean flags", cmd.BuildFlags)
+	}
+}
+
+func TestGoCmdParsingOwnFlags(t *testing.T) {
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	basedir := flagset.String("basedir", "", "")
+	cmd, err := NewGoCmdWithFlags(flagset, ".", "go", "build", "-basedir", "base", "-v", "bobo")
+	OrFail(err, t)
+	expectEq("base", *basedir, t)
+	expectEq("v=true", fmt.Sprint(cmd.BuildFlags), t)
+}
+
+func TestGoCmdParsingChdir(t *testing.T) {
+	cmd, err := NewGoCmd("base", "go", "build", "-C", "sub", "-o", "koko", "bobo")
+	OrFail(err, t)
+	expectEq(filepath.Join("base", "sub"), cmd.WorkDir, t)
+	expectEq("o=koko", fmt.Sprint(cmd.BuildFlags), t)
+	abs, err := filepath.Abs("sub")
+	OrFail(err, t)
+	cmd, err = NewGoCmd("base", "go", "test", "-C="+abs, "bobo")
+	OrFail(err, t)
+	expectEq(abs, cmd.WorkDir, t)
+	expectEq("[bobo]", fmt.Sprint(cmd.Params), t)
+}
+
+func TestGoTestCmdBinaryArgs(t *testing.T) {
+	cmd, err := NewGoCmd(".", "go", "test", "-count", "1", "-race", "-test.run=A", "-v", "-json", "bobo", "-failfast", "-args", "-count", "x")
+	OrFail(err, t)
+	expectEq("[bobo]", fmt.Sprint(cmd.Params), t)
+	expectEq("[-test.count=1 -test.run=A -test.v=true -test.failfast -count x]", fmt.Sprint(cmd.TestBinaryArgs()), t)
+	expectEq("race=true v=true json=true", fmt.Sprint(cmd.BuildFlags), t)
+
+	cmd, err = NewGoCmd(".", "go", "test", "-short", "-args", "-v", "bobo")
+	OrFail(err, t)
+	expectEq("[]", fmt.Sprint(cmd.Params), t)
+	expectEq("[-test.short=true -v bobo]", fmt.Sprint(cmd.TestBinaryArgs()), t)
+
+	// -v is a test flag go test also builds with, whether given as -v or -test.v
+	cmd, err = NewGoCmd(".", "go", "test", "-test.v", "bobo")
+	OrFail(err, t)
+	expectEq("[-test.v=true]", fmt.Sprint(cmd.TestBinaryArgs()), t)
+	expectEq("v=true", fmt.Sprint(cmd.BuildFlags), t)
+	// flags go test does not know, and all arguments after them, are the test binary's
+	cmd, err = NewGoCmd(".", "go", "test", "-race", "-myflag=1", "-count", "2", "bobo")
+	OrFail(err, t)
+	expectEq("[]", fmt.Sprint(cmd.Params), t)
+	expectEq("[-myflag=1 -test.count 2 bobo]", fmt.Sprint(cmd.TestBinaryArgs()), t)
+	expectEq("race=true", fmt.Sprint(cmd.BuildFlags), t)
+}
+
+func TestGoCmdFiles(t *testing.T) {
+	OrFail(dir("pkg",
+		file("prog.go", "package main;func main(){}"),
+		file("help.go", "package main"),
+		file("help_test.go", "package main"),
+		file("x_test.go", "package main_test"),
+	).Build("."), t)
+	defer func() { OrFail(os.RemoveAll("pkg"), t) }()
+	cmd, err := NewGoCmd(".", "go", "build", "pkg/prog.go", "pkg/help.go")
+	OrFail(err, t)
+	if !cmd.HasFiles() {
+		t.Error("expected files in", cmd.Params)
+	}
+	pkg := ImportFiles("", "pkg/prog.go", "pkg/help.go", "pkg/help_test.go", "pkg/x_test.go")
+	expectEq("[pkg/prog.go pkg/help.go pkg/help_test.go]", fmt.Sprint(pkg.TestFiles()), t)
+	expectEq("[pkg/x_test.go]", fmt.Sprint(pkg.XTestFiles()), t)
+}
+
+func TestGoTestCmdFuzzArgs(t *testing.T) {
+	cmd, err := NewGoCmd(".", "go", "test", "-fuzz", "FuzzX", "-fuzztime=10s")
+	OrFail(err, t)
+	expectEq("[-test.fuzz=FuzzX -test.fuzztime=10s]", fmt.Sprint(cmd.TestBinaryArgs()), t)
+	// the test binary must be built for fuzzing as well
+	expectEq("fuzz=FuzzX", fmt.Sprint(cmd.BuildFlags), t)
+}
+
+func TestGoCmdContext(t *testing.T) {
+	OrFail(dir("pkg",
+		file("a.go", "package pkg"),
+		file("tagged.go", "//go:build foo && race\n\npackage pkg"),
+	).Build("."), t)
+	defer func() { OrFail(os.RemoveAll("pkg"), t) }()
+	cmd, err := NewGoCmd(".", "go", "build", "-tags", "bar,foo", "-race")
+	OrFail(err, t)
+	pkg, err := ImportDirContext(cmd.Context(), "", "pkg")
+	OrFail(err, t)
+	expectEq("[pkg/a.go pkg/tagged.go]", fmt.Sprint(pkg.Files()), t)
+	cmd, err = NewGoCmd(".", "go", "build", "-tags", "foo")
+	OrFail(err, t)
+	pkg, err = ImportDirContext(cmd.Context(), "", "pkg")
+	OrFail(err, t)
+	expectEq("[pkg/a.go]", fmt.Sprint(pkg.Files()), t)
+}
+
+func TestGoCmdGetenv(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	cmd, err := NewGoCmd(".", "go", "build")
+	OrFail(err, t)
+	expectEq("off", cmd.Getenv("GOWORK"), t)
+	cmd.Env = []string{"GOWORK=/a/go.work", "GOWORKX=x", "GOWORK=/b/go.work"}
+	expectEq("/b/go.work", cmd.Getenv("GOWORK"), t)
+}
@@ -0,0 +1,304 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"go/build/constraint"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+// knownOS and knownArch are the GOOS and GOARCH values go/build recognizes in file names and tags
+var knownOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+	"hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+	"windows": true, "zos": true,
+}
+
+var unixOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true,
+	"hurd": true, "illumos": true, "ios": true, "linux": true, "netbsd": true,
+	"openbsd": true, "solaris": true,
+}
+
+var knownArch = map[string]bool{
+	"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+	"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true,
+	"mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+	"ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true,
+	"sparc": true, "sparc64": true, "wasm": true,
+}
+
+// maxTags limits the number of custom tags in a constraint we try to satisfy, since every
+// subset of them is tried.
+const maxTags = 12
+
+// BuildConfig is a GOOS, GOARCH and set of build tags, and the ignored files built under it.
+type BuildConfig struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+	Files  []string
+}
+
+func (c *BuildConfig) key() string {
+	return c.GOOS + "/" + c.GOARCH + "/" + strings.Join(c.Tags, ",")
+}
+
+// Context returns ctx, changed to build with the configuration.
+func (c *BuildConfig) Context(ctx *build.Context) *build.Context {
+	r := *ctx
+	r.GOOS, r.GOARCH = c.GOOS, c.GOARCH
+	r.BuildTags = append(append([]string{}, ctx.BuildTags...), c.Tags...)
+	if c.GOOS != ctx.GOOS || c.GOARCH != ctx.GOARCH {
+		// as the go tool, cross compilation is done without cgo
+		r.CgoEnabled = false
+	}
+	return &r
+}
+
+func (c *BuildConfig) String() string {
+	return fmt.Sprintf("GOOS=%s GOARCH=%s -tags=%s", c.GOOS, c.GOARCH, strings.Join(c.Tags, ","))
+}
+
+// IgnoredConfigs returns build configurations under which the Go files of the package that
+// its build context excludes, its IgnoredGoFiles, are built. Files built under the same
+// configuration are grouped together. Test files are included only if withtests is set.
+// Files whose constraints cannot be satisfied are left out, and returned as unsatisfiable.
+func (i *Instrumentable) IgnoredConfigs(withtests bool) (configs []*BuildConfig, unsatisfiable []string, err error) {
+	bykey := map[string]*BuildConfig{}
+	var keys []string
+	for _, file := range i.pkg.IgnoredGoFiles {
+		if !withtests && strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		config, err := satisfyFile(i.context(), filepath.Join(i.pkg.Dir, file))
+		if err != nil {
+			return nil, nil, err
+		}
+		if config == nil {
+			unsatisfiable = append(unsatisfiable, file)
+			continue
+		}
+		if c, ok := bykey[config.key()]; ok {
+			config = c
+		} else {
+			bykey[config.key()] = config
+			keys = append(keys, config.key())
+		}
+		config.Files = append(config.Files, file)
+	}
+	configs = make([]*BuildConfig, len(keys))
+	for n, key := range keys {
+		configs[n] = bykey[key]
+	}
+	return configs, unsatisfiable, nil
+}
+
+func (i *Instrumentable) context() *build.Context {
+	if i.ctx == nil {
+		return &build.Default
+	}
+	return i.ctx
+}
+
+// satisfyFile returns a configuration under which file is built, or nil if there is none.
+// The current GOOS and GOARCH are kept if possible, and the fewest tags possible are added.
+func satisfyFile(ctx *build.Context, file string) (*BuildConfig, error) {
+	expr, err := fileConstraint(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	goos, goarch := fileOSArch(filepath.Base(file))
+	oses, arches := []string{ctx.GOOS}, []string{ctx.GOARCH}
+	if goos != "" {
+		oses = []string{goos}
+	}
+	if goarch != "" {
+		arches = []string{goarch}
+	}
+	var tags []string
+	if expr != nil {
+		seen := map[string]bool{}
+		expr.Eval(func(tag string) bool {
+			if !seen[tag] {
+				seen[tag] = true
+				switch {
+				case knownOS[tag] && goos == "":
+					oses = append(oses, tag)
+				case knownArch[tag] && goarch == "":
+					arches = append(arches, tag)
+				case !knownOS[tag] && !knownArch[tag] && !isContextTag(ctx, tag):
+					tags = append(tags, tag)
+				}
+			}
+			return false
+		})
+	}
+	sort.Strings(tags)
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("%s: too many build tags to find a configuration including it", file)
+	}
+	// subsets ordered by size, so that the fewest tags are added
+	subsets := make([]int, 1<<uint(len(tags)))
+	for n := range subsets {
+		subsets[n] = n
+	}
+	sort.SliceStable(subsets, func(a, b int) bool { return popcount(subsets[a]) < popcount(subsets[b]) })
+	for _, goos := range oses {
+		for _, goarch := range arches {
+			for _, subset := range subsets {
+				config := &BuildConfig{goos, goarch, nil, nil}
+				for n, tag := range tags {
+					if subset&(1<<uint(n)) != 0 {
+						config.Tags = append(config.Tags, tag)
+					}
+				}
+				if expr == nil || expr.Eval(config.matcher(ctx)) {
+					return config, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func popcount(n int) (count int) {
+	for ; n != 0; n &= n - 1 {
+		count++
+	}
+	return
+}
+
+// isContextTag reports whether tag is decided by the build context rather than by -tags,
+// such as release tags, the compiler and cgo.
+func isContextTag(ctx *build.Context, tag string) bool {
+	if tag == "cgo" || tag == "unix" || tag == ctx.Compiler || tag == "gc" || tag == "gccgo" {
+		return true
+	}
+	for _, tags := range [][]string{ctx.ReleaseTags, ctx.ToolTags, ctx.BuildTags} {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matcher reports whether a tag is satisfied under the configuration, added to ctx.
+func (c *BuildConfig) matcher(ctx *build.Context) func(tag string) bool {
+	return func(tag string) bool {
+		switch {
+		case tag == c.GOOS || tag == c.GOARCH:
+			return true
+		case tag == "unix":
+			return unixOS[c.GOOS]
+		case tag == "cgo":
+			return ctx.CgoEnabled && c.GOOS == ctx.GOOS && c.GOARCH == ctx.GOARCH
+		case tag == "linux" && c.GOOS == "android", tag == "darwin" && c.GOOS == "ios",
+			tag == "solaris" && c.GOOS == "illumos":
+			return true
+		case knownOS[tag] || knownArch[tag]:
+			return false
+		}
+		for _, t := range c.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return isContextTag(ctx, tag) && tag != "gccgo" && (tag != "gc" || ctx.Compiler == "gc")
+	}
+}
+
+// fileConstraint returns the //go:build, or // +build, constraint of file, or nil if it has none.
+func fileConstraint(ctx *build.Context, file string) (constraint.Expr, error) {
+	data, err := readFile(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	var plusbuild []constraint.Expr
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") && !strings.HasPrefix(line, "//go:build") && !strings.HasPrefix(line, "// +build") {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			// constraints must appear before the package clause
+			break
+		}
+		if constraint.IsGoBuild(line) {
+			return constraint.Parse(line)
+		}
+		if constraint.IsPlusBuild(line) {
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			plusbuild = append(plusbuild, expr)
+		}
+	}
+	if len(plusbuild) == 0 {
+		return nil, nil
+	}
+	expr := plusbuild[0]
+	for _, e := range plusbuild[1:] {
+		expr = &constraint.AndExpr{X: expr, Y: e}
+	}
+	return expr, nil
+}
+
+// fileOSArch returns the GOOS and GOARCH required by the name of a file, as in name_linux_amd64.go.
+func fileOSArch(name string) (goos, goarch string) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".go"), "_test")
+	parts := strings.Split(name, "_")
+	if n := len(parts); n >= 3 && knownOS[parts[n-2]] && knownArch[parts[n-1]] {
+		return parts[n-2], parts[n-1]
+	} else if n >= 2 && knownOS[parts[n-1]] {
+		return parts[n-1], ""
+	} else if n >= 2 && knownArch[parts[n-1]] {
+		return "", parts[n-1]
+	}
+	return "", ""
+}
+
+// Reimport imports the package again with the build context ctx, keeping its settings.
+func (i *Instrumentable) Reimport(ctx *build.Context) (*Instrumentable, error) {
+	pkg, err := ctx.ImportDir(i.pkg.Dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	if i.ws != nil {
+		pkg.ImportPath = i.pkg.ImportPath
+	}
+	return &Instrumentable{pkg: pkg, basepkg: i.basepkg, why: i.why, parallel: i.parallel, linedirectives: i.linedirectives,
+		ctx: ctx, ws: i.ws, vendor: i.vendor, pkgpatches: i.pkgpatches}, nil
+}
+
+// WithoutConstraints returns f, with patches turning the build constraints of every file into
+// empty comments. Packages instrumented with it build with the files their build context
+// selected, whatever the tags given to the go tool. Constraints on GOOS and GOARCH in file
+// names remain.
+func WithoutConstraints(f func(file *patch.PatchableFile) (patch.Patches, error)) func(file *patch.PatchableFile) (patch.Patches, error) {
+	return func(file *patch.PatchableFile) (patch.Patches, error) {
+		patches, err := f(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range file.File.Comments {
+			if group.Pos() >= file.File.Package {
+				break
+			}
+			for _, c := range group.List {
+				if constraint.IsGoBuild(c.Text) || constraint.IsPlusBuild(c.Text) {
+					patches = append(patches, patch.Replace(c, "//"))
+				}
+			}
+		}
+		return patches, nil
+	}
+}
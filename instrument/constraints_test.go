@@ -0,0 +1,47 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"testing"
+)
+
+func TestIgnoredConfigs(t *testing.T) {
+	fs := dir(
+		"test",
+		file("a.go", "package a\n"),
+		file("scratch.go", "//go:build ignore\n\npackage a\n"),
+		file("old.go", "// +build !go1.1 debug\n\npackage a\n"),
+		file("a_windows.go", "package a\n"),
+		file("b_windows.go", "//go:build !race\n\npackage a\n"),
+		file("c.go", "//go:build (darwin || freebsd) && !arm64 && (trace || debug)\n\npackage a\n"),
+		file("never.go", "//go:build linux && !linux\n\npackage a\n"),
+		file("a_plan9_test.go", "package a\n"),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH, ctx.BuildTags = "linux", "amd64", nil
+	pkg, err := ImportDirContext(&ctx, "", "test")
+	OrFail(err, t)
+	configs, unsatisfiable, err := pkg.IgnoredConfigs(false)
+	OrFail(err, t)
+	expectEq("[never.go]", fmt.Sprint(unsatisfiable), t)
+	var s []string
+	for _, c := range configs {
+		s = append(s, fmt.Sprint(c, c.Files))
+	}
+	expectEq(fmt.Sprint([]string{
+		"GOOS=windows GOARCH=amd64 -tags= [a_windows.go b_windows.go]",
+		"GOOS=darwin GOARCH=amd64 -tags=debug [c.go]",
+		"GOOS=linux GOARCH=amd64 -tags=debug [old.go]",
+		"GOOS=linux GOARCH=amd64 -tags=ignore [scratch.go]",
+	}), fmt.Sprint(s), t)
+	configs, _, err = pkg.IgnoredConfigs(true)
+	OrFail(err, t)
+	expectEq("GOOS=plan9 GOARCH=amd64 -tags= [a_plan9_test.go]", fmt.Sprint(configs[0], configs[0].Files), t)
+	other, err := pkg.Reimport(configs[1].Context(&ctx))
+	OrFail(err, t)
+	expectEq("[a.go a_windows.go b_windows.go]", fmt.Sprint(other.Package().GoFiles), t)
+}
@@ -0,0 +1,150 @@
+package instrument
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RewriteCoverProfile copies the coverage profile r, generated by a test binary built from
+// instrumented packages, to w. Blocks in instrumented files are written with the import path
+// and positions of the original files, and without the statements the instrumentation inserted.
+// Blocks consisting only of text inserted by the instrumentation are dropped.
+// cmd/cover takes the positions of blocks from line directives, so blocks of files with line
+// directives already have original positions, and inserted text cannot be told apart. Build with
+// no line directives for exact profiles.
+func (sm *SourceMap) RewriteCoverProfile(r io.Reader, w io.Writer) error {
+	// inserted are the positions of the inserted statements, by instrumented file
+	inserted := map[string][]token.Position{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "mode:") {
+			var ok bool
+			if line, ok = sm.rewriteCoverBlock(line, inserted); !ok {
+				continue
+			}
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// rewriteCoverBlock rewrites a single "name.go:line.col,line.col numstmt count" line.
+// ok is false if the block should be dropped. inserted caches the result of insertedStmts.
+func (sm *SourceMap) rewriteCoverBlock(line string, inserted map[string][]token.Position) (rewritten string, ok bool) {
+	colon := strings.LastIndex(line, ":")
+	if colon < 0 {
+		return line, true
+	}
+	fields := strings.Fields(line[colon+1:])
+	if len(fields) != 3 {
+		return line, true
+	}
+	// packages out of GOPATH have their directory as import path, sometimes prefixed by "_",
+	// the rest the import path of the original package
+	path := line[:colon]
+	if strings.HasPrefix(path, "_") && filepath.IsAbs(path[1:]) {
+		path = path[1:]
+	} else if dir, ok := sm.pkgDir(pathpkg.Dir(path)); ok {
+		path = filepath.Join(dir, pathpkg.Base(path))
+	}
+	var start, end token.Position
+	if _, err := fmt.Sscanf(fields[0], "%d.%d,%d.%d", &start.Line, &start.Column, &end.Line, &end.Column); err != nil {
+		return line, true
+	}
+	numstmt, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return line, true
+	}
+	start.Filename, end.Filename = path, path
+	origstart, ok := sm.Original(start)
+	if !ok {
+		return line, true
+	}
+	origend, _ := sm.Original(end)
+	if sm.hasLineDirectives(path) {
+		origstart.Line, origstart.Column, origend.Line, origend.Column = start.Line, start.Column, end.Line, end.Column
+	} else if origstart.Offset >= origend.Offset {
+		return "", false
+	} else {
+		if _, ok := inserted[path]; !ok {
+			inserted[path] = sm.insertedStmts(path)
+		}
+		for _, pos := range inserted[path] {
+			if !before(pos, start) && before(pos, end) && numstmt > 0 {
+				numstmt--
+			}
+		}
+	}
+	return fmt.Sprintf("%s:%d.%d,%d.%d %d %s", sm.coverName(origstart.Filename),
+		origstart.Line, origstart.Column, origend.Line, origend.Column, numstmt, fields[2]), true
+}
+
+// before reports whether a is before b, by line and column.
+func before(a, b token.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// insertedStmts returns the positions of the statements the instrumentation inserted in the
+// instrumented file path, which cmd/cover counts in the blocks they are in.
+func (sm *SourceMap) insertedStmts(path string) []token.Position {
+	sm.mu.Lock()
+	f, ok := sm.files[abs(path)]
+	sm.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil
+	}
+	var positions []token.Position
+	add := func(stmts []ast.Stmt) {
+		for _, stmt := range stmts {
+			if pos := fset.PositionFor(stmt.Pos(), false); f.posmap.Inserted(pos) {
+				positions = append(positions, pos)
+			}
+		}
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			add(n.List)
+		case *ast.CaseClause:
+			add(n.Body)
+		case *ast.CommClause:
+			add(n.Body)
+		}
+		return true
+	})
+	return positions
+}
+
+// pkgDir returns the instrumented directory of the package importpath, if it was instrumented.
+func (sm *SourceMap) pkgDir(importpath string) (string, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	dir, ok := sm.pkgdirs[importpath]
+	return dir, ok
+}
+
+// coverName returns the name the go tool would give filename in coverage profiles.
+func (sm *SourceMap) coverName(filename string) string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if importpath, ok := sm.importpaths[filepath.Dir(filename)]; ok {
+		return importpath + "/" + filepath.Base(filename)
+	}
+	return filepath.ToSlash(filename)
+}
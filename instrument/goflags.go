@@ -0,0 +1,130 @@
+package instrument
+
+import "strings"
+
+// goFlag describes a flag of the go command, as defined in cmd/go.
+type goFlag struct {
+	// value is set for flags that take a value, that is, -flag value is allowed.
+	value bool
+	// test is set for flags go test passes to the test binary as -test.flag.
+	test bool
+	// build is set for test flags go test also uses when building the test binary.
+	build bool
+}
+
+// buildFlags are the flags shared by go build, go run and go test. The tables are those of
+// go help build, go help test and go help testflag of go 1.27.
+var buildFlags = map[string]goFlag{
+	"C":             {value: true},
+	"a":             {},
+	"asan":          {},
+	"asmflags":      {value: true},
+	"buildmode":     {value: true},
+	"buildvcs":      {},
+	"compiler":      {value: true},
+	"cover":         {},
+	"covermode":     {value: true},
+	"coverpkg":      {value: true},
+	"gccgoflags":    {value: true},
+	"gcflags":       {value: true},
+	"installsuffix": {value: true},
+	"ldflags":       {value: true},
+	"linkshared":    {},
+	"mod":           {value: true},
+	"modcacherw":    {},
+	"modfile":       {value: true},
+	"msan":          {},
+	"n":             {},
+	"overlay":       {value: true},
+	"p":             {value: true},
+	"pgo":           {value: true},
+	"pkgdir":        {value: true},
+	"race":          {},
+	"tags":          {value: true},
+	"toolexec":      {value: true},
+	"trimpath":      {},
+	"v":             {},
+	"work":          {},
+	"x":             {},
+}
+
+// commandFlags are the flags specific to a single go command.
+var commandFlags = map[string]map[string]goFlag{
+	"build": {
+		"json": {},
+		"o":    {value: true},
+	},
+	"run": {
+		"exec": {value: true},
+	},
+	// diff only prints the changes gosloppy makes, and takes the build flags alone
+	"diff": {},
+	"test": {
+		"c":                    {},
+		"exec":                 {value: true},
+		"i":                    {},
+		"json":                 {},
+		"o":                    {value: true},
+		"vet":                  {value: true},
+		"artifacts":            {test: true},
+		"bench":                {value: true, test: true},
+		"benchmem":             {test: true},
+		"benchtime":            {value: true, test: true},
+		"blockprofile":         {value: true, test: true},
+		"blockprofilerate":     {value: true, test: true},
+		"count":                {value: true, test: true},
+		"coverprofile":         {value: true, test: true},
+		"cpu":                  {value: true, test: true},
+		"cpuprofile":           {value: true, test: true},
+		"failfast":             {test: true},
+		"fullpath":             {test: true},
+		"fuzz":                 {value: true, test: true, build: true},
+		"fuzzminimizetime":     {value: true, test: true},
+		"fuzztime":             {value: true, test: true},
+		"list":                 {value: true, test: true},
+		"memprofile":           {value: true, test: true},
+		"memprofilerate":       {value: true, test: true},
+		"mutexprofile":         {value: true, test: true},
+		"mutexprofilefraction": {value: true, test: true},
+		"outputdir":            {value: true, test: true},
+		"parallel":             {value: true, test: true},
+		"run":                  {value: true, test: true},
+		"short":                {test: true},
+		"shuffle":              {value: true, test: true},
+		"skip":                 {value: true, test: true},
+		"timeout":              {value: true, test: true},
+		"trace":                {value: true, test: true},
+		"v":                    {test: true, build: true},
+	},
+}
+
+// lookupGoFlag returns the definition of the flag name of the go command.
+// Test flags may be given with the "test." prefix, which is removed from the returned name.
+func lookupGoFlag(command, name string) (canonical string, f goFlag, ok bool) {
+	if f, ok := commandFlags[command][name]; ok {
+		return name, f, true
+	}
+	if f, ok := buildFlags[name]; ok {
+		return name, f, true
+	}
+	if command == "test" && strings.HasPrefix(name, "test.") {
+		short := strings.TrimPrefix(name, "test.")
+		if f, ok := commandFlags[command][short]; ok && f.test {
+			return short, f, true
+		}
+	}
+	return name, goFlag{}, false
+}
+
+// splitFlag splits a "-name=value" or "--name" command line argument.
+func splitFlag(arg string) (name, value string, hasvalue bool) {
+	name = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if i := strings.Index(name, "="); i >= 0 {
+		return name[:i], name[i+1:], true
+	}
+	return name, "", false
+}
+
+func isFlag(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-' && arg != "--"
+}
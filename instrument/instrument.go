@@ -1,11 +1,16 @@
 package instrument
 
 import (
+	"go/ast"
 	"go/build"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/elazarl/gosloppy/patch"
 )
@@ -15,7 +20,23 @@ import (
 type Instrumentable struct {
 	pkg     *build.Package
 	basepkg string
-	name    string
+	// why tells why basepkg was guessed, empty if it was given
+	why            string
+	parallel       int
+	linedirectives bool
+	sourcemap      *SourceMap
+	// outdir is where the package was instrumented to
+	outdir string
+	// gowork is the go.work file written with the package, "off" if none was
+	gowork string
+	// ctx is the build context packages are imported with
+	ctx *build.Context
+	// ws is the workspace of modules the package is in, nil in GOPATH mode
+	ws *Workspace
+	// vendor is set to instrument vendored packages, see SetVendor
+	vendor bool
+	// pkgpatches adds, replaces or removes files of the packages, see SetPackagePatches
+	pkgpatches func(pkg *patch.PatchablePkg) patch.FilePatches
 }
 
 // Files will give all .go files of a go pacakge
@@ -51,25 +72,10 @@ func (i *Instrumentable) XTestFiles() (files []string) {
 	return
 }
 
-func guessBasepkg(importpath string) string {
-	path, err := repoRootForImportPathStatic(importpath)
-	if err != nil {
-		p := importpath
-		for strings.Contains(p, "/") {
-			parent := filepath.Dir(p)
-			if _, err := build.Import(parent, "", 0); err != nil {
-				return p
-			}
-			p = parent
-		}
-		return p
-	}
-	return path.root
-}
-
 // Import gives an Instrumentable for a given package name, it will instrument pkgname
 // and all subpacakges of basepkg that pkgname imports.
-// Leave basepkg empty to have Import guess it for you.
+// Leave basepkg empty to have Import guess it for you, from the module, or the go.work, the package
+// is in, and from the prefixes listed in GOSLOPPYPREFIXES. Basepkg tells why it was guessed.
 // The conservative default for basepkg is basepkg==pkgname.
 // For example, if we have packages a/x a/b and a/b/c in GOPATH
 //     gopath/src
@@ -84,36 +90,157 @@ func guessBasepkg(importpath string) string {
 // If our package is not in $GOPATH, (typically built with `cd pkg;go build -o a.out`), the
 // default empty basepkg will always import all relative paths.
 func Import(basepkg, pkgname string) (*Instrumentable, error) {
-	pkg, err := build.Import(pkgname, "", 0)
+	return ImportContext(&build.Default, basepkg, pkgname)
+}
+
+// ImportContext is like Import, but imports pkgname, and the packages it imports, with the
+// build context ctx, which determines the files to instrument.
+// In module mode, packages of the workspace modules are imported from their module, and only
+// workspace modules are instrumented. The workspace is the one of ctx.Dir, or of the working
+// directory when ctx.Dir is empty, and packages pkgname imports are imported from the same
+// workspace. See FindWorkspace.
+func ImportContext(ctx *build.Context, basepkg, pkgname string) (*Instrumentable, error) {
+	ws, err := FindWorkspace(contextDir(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return importWorkspace(ctx, ws, basepkg, pkgname)
+}
+
+// contextDir returns the directory import paths are resolved from with ctx.
+func contextDir(ctx *build.Context) string {
+	if ctx.Dir != "" {
+		return ctx.Dir
+	}
+	return "."
+}
+
+// importWorkspace imports pkgname with ctx from the workspace ws, nil in GOPATH mode.
+func importWorkspace(ctx *build.Context, ws *Workspace, basepkg, pkgname string) (*Instrumentable, error) {
+	if ws != nil && ws.ModuleFor(pkgname) != nil {
+		pkg, err := importModule(ctx, ws, pkgname)
+		if err != nil {
+			return nil, err
+		}
+		basepkg, why := guessIfEmpty(ctx, basepkg, pkg)
+		return &Instrumentable{pkg: pkg, basepkg: basepkg, why: why, ctx: ctx, ws: ws}, nil
+	}
+	pkg, err := ctx.Import(pkgname, "", 0)
 	if err != nil {
 		return nil, err
 	}
-	if basepkg == "" {
-		basepkg = guessBasepkg(pkg.ImportPath)
+	basepkg, why := guessIfEmpty(ctx, basepkg, pkg)
+	return &Instrumentable{pkg: pkg, basepkg: basepkg, why: why, ctx: ctx}, nil
+}
+
+// guessIfEmpty returns basepkg, or, if it is empty, the base package guessed for pkg and why.
+func guessIfEmpty(ctx *build.Context, basepkg string, pkg *build.Package) (string, string) {
+	if basepkg != "" {
+		return basepkg, ""
 	}
-	return &Instrumentable{pkg, basepkg, pkgname}, nil
+	return guessBasepkg(ctx, pkg.ImportPath, pkg.Dir)
 }
 
+// ImportFiles gives an Instrumentable for the package made of the given .go files, as in
+// `go build a.go b.go`. _test.go files are the tests of the package.
 func ImportFiles(basepkg string, files ...string) *Instrumentable {
-	return &Instrumentable{&build.Package{GoFiles: files}, basepkg, ""}
+	return ImportFilesContext(&build.Default, basepkg, files...)
+}
+
+// ImportFilesContext is like ImportFiles, but imports the packages the files import with ctx.
+// As with the go tool, build constraints of files given explicitly are ignored. The package is
+// named by its first file.
+func ImportFilesContext(ctx *build.Context, basepkg string, files ...string) *Instrumentable {
+	pkg := &build.Package{}
+	for _, file := range files {
+		switch {
+		case !strings.HasSuffix(file, "_test.go"):
+			pkg.GoFiles = append(pkg.GoFiles, file)
+		case isXTest(ctx, file):
+			pkg.XTestGoFiles = append(pkg.XTestGoFiles, file)
+		default:
+			pkg.TestGoFiles = append(pkg.TestGoFiles, file)
+		}
+	}
+	if len(pkg.GoFiles) > 0 {
+		pkg.Name = packageName(ctx, pkg.GoFiles[0])
+	}
+	return &Instrumentable{pkg: pkg, basepkg: basepkg, ctx: ctx}
+}
+
+// isXTest reports whether file belongs to an external test package.
+func isXTest(ctx *build.Context, file string) bool {
+	return strings.HasSuffix(packageName(ctx, file), "_test")
+}
+
+// packageName returns the name of the package of file, "" if it cannot be parsed.
+func packageName(ctx *build.Context, file string) string {
+	src, err := readFile(ctx, file)
+	if err != nil {
+		return ""
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), file, src, parser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return f.Name.Name
 }
 
 // ImportDir gives a single instrumentable golang package. See Import.
 func ImportDir(basepkg, pkgname string) (*Instrumentable, error) {
-	pkg, err := build.ImportDir(pkgname, 0)
+	return ImportDirContext(&build.Default, basepkg, pkgname)
+}
+
+// ImportDirContext is like ImportDir, with the build context ctx. See ImportContext.
+// A directory in a module of the workspace of the directory is given its import path in the module.
+func ImportDirContext(ctx *build.Context, basepkg, pkgname string) (*Instrumentable, error) {
+	ws, err := FindWorkspace(pkgname)
 	if err != nil {
 		return nil, err
 	}
-	return &Instrumentable{pkg, basepkg, pkgname}, nil
+	return importDirWorkspace(ctx, ws, basepkg, pkgname)
+}
+
+// importDirWorkspace imports the package in dir with ctx from the workspace ws, nil in GOPATH mode.
+func importDirWorkspace(ctx *build.Context, ws *Workspace, basepkg, dir string) (*Instrumentable, error) {
+	pkg, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ws != nil && !moduleImportPath(ws, pkg) {
+		ws = nil
+	}
+	why := ""
+	if ws != nil {
+		// only packages of modules have an import path to guess from
+		basepkg, why = guessIfEmpty(ctx, basepkg, pkg)
+	}
+	return &Instrumentable{pkg: pkg, basepkg: basepkg, why: why, ctx: ctx, ws: ws}, nil
+}
+
+// Basepkg returns the base package of the package, and why it was guessed, empty when it was given.
+func (i *Instrumentable) Basepkg() (basepkg, why string) {
+	return i.basepkg, i.why
+}
+
+// Package returns the package to be instrumented.
+func (i *Instrumentable) Package() *build.Package {
+	return i.pkg
 }
 
 // IsInGopath returns whether the Instrumentable is a package in a standalone directory or in GOPATH
 func (i *Instrumentable) IsInGopath() bool {
-	return i.pkg.ImportPath != "."
+	// packages given by a list of files have no import path at all
+	return i.pkg.ImportPath != "." && i.pkg.ImportPath != ""
 }
 
 // relevantImport will determine whether this import should be instrumented as well
 func (i *Instrumentable) relevantImport(imp string) bool {
+	if i.ws != nil && !build.IsLocalImport(imp) {
+		// only workspace modules can be replaced by their instrumented copies
+		return i.ws.ModuleFor(imp) != nil && (i.basepkg == "" || i.basepkg == "*" ||
+			filepath.HasPrefix(imp, i.basepkg) || filepath.HasPrefix(i.basepkg, imp))
+	}
 	if i.basepkg == "*" || build.IsLocalImport(imp) {
 		return true
 	} else if i.IsInGopath() || i.basepkg != "" {
@@ -123,22 +250,29 @@ func (i *Instrumentable) relevantImport(imp string) bool {
 }
 
 func (i *Instrumentable) doimport(pkg string) (*Instrumentable, error) {
+	// imported packages are in the workspace of the importing package, which is not looked up again
 	if build.IsLocalImport(pkg) {
-		return ImportDir(i.basepkg, filepath.Join(i.pkg.Dir, pkg))
+		return importDirWorkspace(i.ctx, i.ws, i.basepkg, filepath.Join(i.pkg.Dir, pkg))
 	}
-	// TODO: A bit hackish
-	r, err := Import(i.basepkg, pkg)
-	if err != nil {
-		return r, err
+	if i.ws != nil {
+		p, err := importModule(i.ctx, i.ws, pkg)
+		if err != nil {
+			return nil, err
+		}
+		return &Instrumentable{pkg: p, basepkg: i.basepkg, why: i.why, ctx: i.ctx, ws: i.ws, vendor: i.vendor}, nil
 	}
-	r.name = i.name
-	return r, nil
+	return importWorkspace(i.ctx, nil, i.basepkg, pkg)
 }
 
 var tempStem = "__instrument.go"
 
-func (i *Instrumentable) Instrument(withtests bool, f func(file *patch.PatchableFile) patch.Patches) (pkgdir string, err error) {
-	d, err := ioutil.TempDir(os.TempDir(), tempStem)
+// TempDir creates a new temporary directory to instrument packages into.
+func TempDir() (string, error) {
+	return ioutil.TempDir(os.TempDir(), tempStem)
+}
+
+func (i *Instrumentable) Instrument(withtests bool, f func(file *patch.PatchableFile) (patch.Patches, error)) (pkgdir string, err error) {
+	d, err := TempDir()
 	if err != nil {
 		return "", err
 	}
@@ -156,116 +290,524 @@ func localize(pkg string) string {
 
 // InstrumentTo will instrument all files in Instrumentable into outdir. It will instrument all subpackages
 // as described in Import.
-func (i *Instrumentable) InstrumentTo(withtests bool, outdir string, f func(file *patch.PatchableFile) patch.Patches) error {
-	return i.instrumentTo(map[string]bool{}, withtests, outdir, "", f)
+// Every package is written to its own directory below outdir, given by OutDir for the package itself.
+// Packages, and files within a package, are instrumented concurrently, using at most SetParallel
+// goroutines, thus f may be called concurrently from several goroutines. The first error f returns
+// is returned.
+func (i *Instrumentable) InstrumentTo(withtests bool, outdir string, f func(file *patch.PatchableFile) (patch.Patches, error)) error {
+	in := newInstrumenter(i.parallel, outdir, f)
+	in.linedirectives, in.vendor, in.pkgpatches = i.linedirectives, i.vendor, i.pkgpatches
+	i.sourcemap, i.outdir = in.sourcemap, filepath.Join(outdir, i.outpath())
+	if err := in.collect(i, withtests); err != nil {
+		return err
+	}
+	if err := in.run(); err != nil {
+		return err
+	}
+	i.gowork = in.goWork()
+	return nil
 }
 
-func (i *Instrumentable) instrumentTo(processed map[string]bool, istest bool, outdir, relpath string, f func(file *patch.PatchableFile) patch.Patches) error {
-	if processed[relpath] {
+// InstrumentAllTo instruments several packages, and the subpackages they import, into outdir.
+// Packages imported by more than one of pkgs are instrumented once.
+// The parallelism, line directives, vendor and package patches settings of the first package apply
+// to all.
+func InstrumentAllTo(pkgs []*Instrumentable, withtests bool, outdir string, f func(file *patch.PatchableFile) (patch.Patches, error)) error {
+	if len(pkgs) == 0 {
 		return nil
 	}
-	processed[i.pkg.ImportPath] = true
+	in := newInstrumenter(pkgs[0].parallel, outdir, f)
+	in.linedirectives, in.vendor, in.pkgpatches = pkgs[0].linedirectives, pkgs[0].vendor, pkgs[0].pkgpatches
+	for _, i := range pkgs {
+		if i.IsInGopath() {
+			in.roots[i.pkg.ImportPath] = true
+		}
+	}
+	for _, i := range pkgs {
+		i.sourcemap, i.outdir = in.sourcemap, filepath.Join(outdir, i.outpath())
+		if err := in.collect(i, withtests); err != nil {
+			return err
+		}
+	}
+	if err := in.run(); err != nil {
+		return err
+	}
+	for _, i := range pkgs {
+		i.gowork = in.goWork()
+	}
+	return nil
+}
+
+// OutDir returns the directory the package was instrumented to.
+func (i *Instrumentable) OutDir() string {
+	return i.outdir
+}
+
+// GoEnv returns the environment the go tool needs to build the instrumented package. GOWORK names
+// the go.work written with it, or turns workspaces off, since a GOWORK of the user would name the
+// original modules.
+func (i *Instrumentable) GoEnv() []string {
+	return []string{"GOWORK=" + i.gowork}
+}
+
+// SourceMap maps the files written by the last instrumentation back to the original sources.
+func (i *Instrumentable) SourceMap() *SourceMap {
+	return i.sourcemap
+}
+
+// SetLineDirectives makes the instrumented files contain line directives, so that positions
+// reported by the compiler and the runtime match the original files. See patch.PatchableFile.
+func (i *Instrumentable) SetLineDirectives(on bool) {
+	i.linedirectives = on
+}
+
+// SetPackagePatches sets f to be called with every instrumented package, after it is parsed, to
+// add, replace or remove its files. Files f adds or replaces are written to the output as they
+// are, and are not instrumented further. f is called once for every package: when instrumenting
+// with tests, the package has its test files, and its external test package is its XTest.
+// Packages are instrumented concurrently, thus f may be called concurrently from several goroutines.
+func (i *Instrumentable) SetPackagePatches(f func(pkg *patch.PatchablePkg) patch.FilePatches) {
+	i.pkgpatches = f
+}
+
+// SetParallel sets the maximal number of files parsed or instrumented at the same time.
+// Non positive n means runtime.NumCPU().
+func (i *Instrumentable) SetParallel(n int) {
+	i.parallel = n
+}
+
+// job is a set of files of a single package, that should be parsed together and written to the
+// same directory.
+type job struct {
+	pkg   *Instrumentable
+	files []string
+	// assets are the non Go files to mirror into the output, see Instrumentable.Assets
+	assets []string
+	// group are the jobs of the package, sharing its parsed files
+	group *jobGroup
+}
+
+// jobGroup is the jobs of a single package: its library, or its library and tests, and its external
+// tests. The files of all the jobs are parsed once, so that package patches apply to the package
+// as a whole.
+type jobGroup struct {
+	jobs []*job
+	once sync.Once
+	// files are the parsed files of every job
+	files [][]*patch.PatchableFile
+	// patches are the package patches of the package, see SetPackagePatches
+	patches patch.FilePatches
+	err     error
+}
+
+// newJobs returns a job for every list of files of the package i, all in the same group.
+func newJobs(i *Instrumentable, assets []string, files ...[]string) []*job {
+	g := &jobGroup{}
+	for n, f := range files {
+		j := &job{i, f, nil, g}
+		if n == 0 {
+			j.assets = assets
+		}
+		g.jobs = append(g.jobs, j)
+	}
+	return g.jobs
+}
+
+// instrumenter first walks the import graph sequentially, to have a deterministic list of jobs
+// with each package appearing once, and then runs the jobs concurrently.
+type instrumenter struct {
+	outdir    string
+	f         func(file *patch.PatchableFile) (patch.Patches, error)
+	sem       chan struct{}
+	processed map[string]bool
+	jobs      []*job
+	// libjobs are the jobs of packages collected without their tests, by key
+	libjobs map[string]*job
+	// roots are the import paths of the packages given to InstrumentAllTo, which are
+	// instrumented wherever they are imported
+	roots map[string]bool
+	// imports are the output paths of the packages instrumented imports resolve to, by the
+	// output path of the importing package and the import path
+	imports   map[string]string
+	sourcemap *SourceMap
+	// linedirectives is set on every instrumented file
+	linedirectives bool
+	// ws is the workspace of the instrumented packages in module mode, and modules are the
+	// workspace modules with instrumented packages
+	ws      *Workspace
+	modules map[*Module]bool
+	// vendor is set to instrument vendored packages rather than copy them
+	vendor bool
+	// pkgpatches is called for every package before its files are instrumented, if set
+	pkgpatches func(pkg *patch.PatchablePkg) patch.FilePatches
+	// vendored caches the vendored import paths GOPATH imports resolve to, see vendoredImport
+	vendored map[string]string
+	vendormu sync.Mutex
+}
+
+func newInstrumenter(parallel int, outdir string, f func(file *patch.PatchableFile) (patch.Patches, error)) *instrumenter {
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+	return &instrumenter{
+		outdir:    outdir,
+		f:         f,
+		sem:       make(chan struct{}, parallel),
+		processed: map[string]bool{},
+		libjobs:   map[string]*job{},
+		roots:     map[string]bool{},
+		imports:   map[string]string{},
+		sourcemap: NewSourceMap(),
+		modules:   map[*Module]bool{},
+		vendored:  map[string]string{},
+	}
+}
+
+// key identifies the package regardless of the import path used to reach it, so that diamond
+// dependencies, e.g. "./a" and "./b/../a", are instrumented once.
+func (i *Instrumentable) key() string {
+	return i.outpath()
+}
+
+// relevantImport reports whether imp, imported by i, is instrumented. In GOPATH mode, vendored
+// packages are always part of the output, since only there the vendor directory is found.
+func (in *instrumenter) relevantImport(i *Instrumentable, imp string) bool {
+	if in.vendoredImport(i, imp) != "" {
+		return i.ws == nil || in.vendor
+	}
+	return in.roots[imp] || i.relevantImport(imp) || i.visibleInternal(imp)
+}
+
+func (in *instrumenter) collect(i *Instrumentable, istest bool) error {
+	key := i.key()
+	if in.processed[key] {
+		if j := in.libjobs[key]; j != nil && istest {
+			// a package given to InstrumentAllTo that an earlier one imports
+			assets, err := i.Assets(true)
+			if err != nil {
+				return err
+			}
+			j.files, j.assets = i.TestFiles(), assets
+			xtest := &job{i, i.XTestFiles(), nil, j.group}
+			j.group.jobs = append(j.group.jobs, xtest)
+			in.jobs = append(in.jobs, xtest)
+			delete(in.libjobs, key)
+		}
+		return nil
+	}
+	in.processed[key] = true
+	if i.ws != nil {
+		in.ws = i.ws
+		in.modules[i.ws.ModuleFor(i.pkg.ImportPath)] = true
+	}
 	for _, imps := range [][]string{i.pkg.Imports, i.pkg.TestImports, i.pkg.XTestImports} {
 		for _, imp := range imps {
-			if i.relevantImport(imp) {
-				pkg, err := i.doimport(imp)
+			if in.relevantImport(i, imp) {
+				var pkg *Instrumentable
+				var err error
+				if in.vendoredImport(i, imp) != "" {
+					pkg, err = i.importVendored(imp)
+				} else {
+					pkg, err = i.doimport(imp)
+				}
 				if err != nil {
 					return err
 				}
-				if build.IsLocalImport(imp) {
-					imp = "./" + filepath.Join(relpath, imp)
-				}
-				if err := pkg.instrumentTo(processed, false, outdir, imp, f); err != nil {
+				in.imports[key+"\x00"+imp] = pkg.outpath()
+				if err := in.collect(pkg, false); err != nil {
 					return err
 				}
 			}
 		}
 	}
+	assets, err := i.Assets(istest)
+	if err != nil {
+		return err
+	}
 	if !istest {
-		pkg := patch.NewPatchablePkg()
-		if err := pkg.ParseFiles(i.Files()...); err != nil {
+		in.jobs = append(in.jobs, newJobs(i, assets, i.Files())...)
+		in.libjobs[key] = in.jobs[len(in.jobs)-1]
+	} else {
+		in.jobs = append(in.jobs, newJobs(i, assets, i.TestFiles(), i.XTestFiles())...)
+	}
+	return nil
+}
+
+// parallel calls f(0)...f(n-1), each in its own goroutine, while limiting the number of
+// concurrently running calls. It returns the error of the smallest index that failed.
+func (in *instrumenter) parallel(n int, f func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			in.sem <- struct{}{}
+			defer func() { <-in.sem }()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
-		if err := i.instrumentPatchable(outdir, relpath, pkg, f); err != nil {
+	}
+	return nil
+}
+
+func (in *instrumenter) run() error {
+	errs := make([]error, len(in.jobs))
+	var wg sync.WaitGroup
+	wg.Add(len(in.jobs))
+	// jobs do not hold a semaphore slot themselves, only the files they process do, so waiting for
+	// the files would never deadlock.
+	for n, j := range in.jobs {
+		go func(n int, j *job) {
+			defer wg.Done()
+			errs[n] = in.runJob(j)
+		}(n, j)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
-	} else {
-		pkg := patch.NewPatchablePkg()
-		if err := pkg.ParseFiles(i.TestFiles()...); err != nil {
-			return err
+	}
+	if in.ws != nil {
+		// imports of workspace packages resolve to the instrumented copies through go.work
+		return in.ws.writeWorkspace(in.outdir, in.modules, in.sourcemap)
+	}
+	return nil
+}
+
+// goWork returns the go.work file run writes, or "off" if it writes none.
+func (in *instrumenter) goWork() string {
+	if in.ws == nil || in.ws.File == "" {
+		return "off"
+	}
+	// the go tool runs in the package directory, not where gosloppy does
+	gowork, err := filepath.Abs(filepath.Join(in.outdir, "go.work"))
+	if err != nil {
+		return filepath.Join(in.outdir, "go.work")
+	}
+	return gowork
+}
+
+func (in *instrumenter) runJob(j *job) error {
+	if err := in.parseGroup(j.group); err != nil {
+		return err
+	}
+	var files []*patch.PatchableFile
+	own := map[string]bool{}
+	for n, g := range j.group.jobs {
+		if g == j {
+			files = j.group.files[n]
 		}
-		if err := i.instrumentPatchable(outdir, relpath, pkg, f); err != nil {
-			return err
+	}
+	for _, name := range j.files {
+		own[filepath.Base(name)] = true
+	}
+	// files are added by the first job of the package, and replaced or removed by the job having them
+	var filepatches patch.FilePatches
+	for _, p := range j.group.patches {
+		if p.Op == patch.AddOp && j == j.group.jobs[0] || p.Op != patch.AddOp && own[p.Name] {
+			filepatches = append(filepatches, p)
+		}
+	}
+	if err := j.pkg.instrumentPatchable(in, files, filepatches); err != nil {
+		return err
+	}
+	return in.mirror(j)
+}
+
+// parseGroup parses the files of all jobs of the group, once, and computes the package patches of
+// the package they make, with the external test package as its XTest.
+func (in *instrumenter) parseGroup(g *jobGroup) error {
+	g.once.Do(func() {
+		var names []string
+		for _, j := range g.jobs {
+			names = append(names, j.files...)
 		}
-		pkg = patch.NewPatchablePkg()
-		if err := pkg.ParseFiles(i.XTestFiles()...); err != nil {
+		files := make([]*patch.PatchableFile, len(names))
+		if g.err = in.parallel(len(names), func(n int) (err error) {
+			src, err := readFile(g.jobs[0].pkg.context(), names[n])
+			if err != nil {
+				return err
+			}
+			files[n], err = patch.ParsePatchableSource(names[n], src)
 			return err
+		}); g.err != nil {
+			return
 		}
-		if err := i.instrumentPatchable(outdir, relpath, pkg, f); err != nil {
+		// every job is a package of its own, with its own scope
+		var pkg *patch.PatchablePkg
+		for _, j := range g.jobs {
+			jobpkg := patch.NewPatchablePkg()
+			for _, file := range files[:len(j.files)] {
+				file.LineDirectives = in.linedirectives
+				jobpkg.AddFile(file.FileName, file)
+			}
+			g.files = append(g.files, files[:len(j.files)])
+			files = files[len(j.files):]
+			if pkg == nil {
+				pkg = jobpkg
+			} else if len(jobpkg.Files) > 0 {
+				pkg.XTest = jobpkg
+			}
+		}
+		i := g.jobs[0].pkg
+		if in.pkgpatches != nil && (in.vendor || !i.isVendored()) && len(names) > 0 {
+			g.patches = in.pkgpatches(pkg)
+			g.err = pkg.ValidateFiles(g.patches)
+		}
+	})
+	return g.err
+}
+
+// mirror links the assets of the job's package into its output directory.
+func (in *instrumenter) mirror(j *job) error {
+	outdir := filepath.Join(in.outdir, j.pkg.outpath())
+	return in.parallel(len(j.assets), func(n int) error {
+		dst := filepath.Join(outdir, j.assets[n])
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 			return err
 		}
+		src := filepath.Join(j.pkg.pkg.Dir, j.assets[n])
+		in.sourcemap.AddCopy(dst, src)
+		return linkOrCopy(src, dst)
+	})
+}
+
+// outpath returns the path, relative to the output, the package is instrumented to. Packages keep
+// the directory hierarchy they have in GOPATH, in their module, or, for packages out of GOPATH, in
+// the file system, since it determines which internal packages they may import.
+func (i *Instrumentable) outpath() string {
+	if i.isVendored() && i.ws != nil {
+		return filepath.Join(i.ws.vendorOutpath(), filepath.FromSlash(i.pkg.ImportPath))
+	} else if i.isVendored() {
+		return vendoredOutpath(i.pkg.ImportPath)
 	}
-	return nil
+	if i.ws != nil && i.IsInGopath() {
+		// module packages keep their place in the module, next to its go.mod
+		return filepath.Join("modules", filepath.FromSlash(i.pkg.ImportPath))
+	}
+	if i.IsInGopath() {
+		return filepath.Join("gopath", filepath.FromSlash(i.pkg.ImportPath))
+	}
+	dir := abs(i.dir())
+	return filepath.Join("locals", dir[len(filepath.VolumeName(dir)):])
 }
 
-func (i *Instrumentable) instrumentPatchable(outdir, relpath string, pkg *patch.PatchablePkg, f func(file *patch.PatchableFile) patch.Patches) error {
-	path := ""
-	if build.IsLocalImport(relpath) {
-		path = filepath.Join("locals", relpath)
-		path = strings.Replace(path, "..", "__", -1)
-	} else if relpath != "" {
-		path = filepath.Join("gopath", i.pkg.ImportPath)
+// dir returns the directory of the package, which for a list of files is the directory of the files.
+func (i *Instrumentable) dir() string {
+	if i.pkg.Dir != "" {
+		return i.pkg.Dir
 	}
-	if err := os.MkdirAll(filepath.Join(outdir, path), 0755); err != nil {
+	for _, files := range [][]string{i.pkg.GoFiles, i.pkg.TestGoFiles, i.pkg.XTestGoFiles} {
+		if len(files) > 0 {
+			return filepath.Dir(files[0])
+		}
+	}
+	return "."
+}
+
+// instrumentPatchable writes the files of the package, and the package patches of the files, to
+// its output directory.
+func (i *Instrumentable) instrumentPatchable(in *instrumenter, files []*patch.PatchableFile, filepatches patch.FilePatches) error {
+	path := i.outpath()
+	if err := os.MkdirAll(filepath.Join(in.outdir, path), 0755); err != nil {
 		return err
 	}
-	for filename, file := range pkg.Files {
-		if outfile, err := os.Create(filepath.Join(outdir, path, filepath.Base(filename))); err != nil {
+	patchable := in.vendor || !i.isVendored()
+	// changed are the files replaced or removed as a whole, which are not instrumented
+	changed := map[string]bool{}
+	for _, p := range filepatches {
+		changed[p.Name] = true
+		if p.Op == patch.RemoveOp {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(in.outdir, path, p.Name), []byte(p.Content), 0644); err != nil {
 			return err
-		} else {
-			patches := f(file)
-			// TODO(elazar): check the relative path from current location (aka relpath, path), to the import path
-			// (aka v)
-			for _, imp := range file.File.Imports {
-				switch v := imp.Path.Value[1 : len(imp.Path.Value)-1]; {
-				case v == i.pkg.ImportPath:
-					patches = appendNoContradict(patches, patch.Replace(imp.Path, `"."`))
-				case !i.relevantImport(v):
-					continue
-				case build.IsLocalImport(v):
-					rel, err := filepath.Rel(path, filepath.Join("locals", v))
-					if err != nil {
-						return err
-					}
-					patches = appendNoContradict(patches, patch.Replace(imp.Path, `"./`+rel+`"`))
-				default:
-					if v == i.name {
-						v = ""
-					} else {
-						v = filepath.Join("gopath", v)
-					}
-					rel, err := filepath.Rel(path, v)
-					if err != nil {
-						return err
-					}
-					patches = appendNoContradict(patches, patch.Replace(imp.Path, `"./`+rel+`"`))
-				}
-			}
-			file.FprintPatched(outfile, file.File, patches)
-			if err := outfile.Close(); err != nil {
+		}
+	}
+	if len(files) > 0 {
+		importpath := ""
+		if i.IsInGopath() {
+			importpath = i.pkg.ImportPath
+		}
+		in.sourcemap.AddDir(filepath.Join(in.outdir, path), filepath.Dir(files[0].FileName), importpath)
+	}
+	return in.parallel(len(files), func(n int) error {
+		file := files[n]
+		if changed[filepath.Base(file.FileName)] {
+			return nil
+		}
+		outname := filepath.Join(in.outdir, path, filepath.Base(file.FileName))
+		outfile, err := os.Create(outname)
+		if err != nil {
+			return err
+		}
+		var patches patch.Patches
+		if patchable {
+			if patches, err = in.f(file); err != nil {
+				outfile.Close()
 				return err
 			}
 		}
-	}
-	return nil
+		var rewrites patch.Patches
+		for _, imp := range file.File.Imports {
+			v := imp.Path.Value[1 : len(imp.Path.Value)-1]
+			target, ok := in.imports[path+"\x00"+v]
+			switch {
+			case i.ws != nil:
+				// import paths are resolved by the generated go.work
+				continue
+			case replaced(patches, imp.Path):
+				// the instrumentation changed the import, there is nothing left to rewrite
+				continue
+			case v == i.pkg.ImportPath:
+				rewrites = append(rewrites, patch.Replace(imp.Path, `"."`))
+			case ok:
+				rel, err := filepath.Rel(path, target)
+				if err != nil {
+					outfile.Close()
+					return err
+				}
+				rewrites = append(rewrites, patch.Replace(imp.Path, `"`+localImport(rel)+`"`))
+			}
+		}
+		patches, err = file.Merge(patch.Set{Name: "instrumentation", Patches: patches},
+			patch.Set{Name: "import rewriting", Patches: rewrites})
+		if err != nil {
+			outfile.Close()
+			return err
+		}
+		posmap, _, err := file.FprintPatchedMap(outfile, file.File, patches)
+		if err != nil {
+			outfile.Close()
+			return err
+		}
+		in.sourcemap.AddFile(outname, file.FileName, posmap, file.LineDirectives)
+		return outfile.Close()
+	})
 }
 
-func appendNoContradict(patches patch.Patches, toadd patch.Patch) patch.Patches {
+// replaced reports whether one of patches replaces text the node nd is in.
+func replaced(patches patch.Patches, nd ast.Node) bool {
 	for _, p := range patches {
-		if toadd.EndPos() <= p.EndPos() && toadd.EndPos() >= p.StartPos() ||
-			toadd.StartPos() <= p.EndPos() && toadd.StartPos() >= p.StartPos() {
-			return patches
+		if p.StartPos() < p.EndPos() && p.StartPos() <= nd.Pos() && nd.End() <= p.EndPos() {
+			return true
 		}
 	}
-	return append(patches, toadd)
+	return false
+}
+
+// localImport returns the canonical local import path of the relative path rel.
+func localImport(rel string) string {
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return rel
+	}
+	return "./" + rel
 }
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/elazarl/gosloppy/patch"
@@ -25,16 +27,16 @@ func TestDir(t *testing.T) {
 	if fmt.Sprint(pkg.Files()) != "[test1/a.go]" {
 		t.Fatal("Expected [a.go] got", pkg.Files())
 	}
-	outdir, err := pkg.Instrument(true, func(pf *patch.PatchableFile) patch.Patches {
-		return patch.Patches{patch.Replace(pf.File, "koko")}
+	outdir, err := pkg.Instrument(true, func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 	})
 
 	defer func() { OrFail(os.RemoveAll(outdir), t) }()
 	OrFail(err, t)
-	dir(filepath.Base(outdir),
+	dir(filepath.Base(outdir), localsDir(t, "test1",
 		file("a.go", "koko"),
 		file("a_test.go", "koko"),
-	).AssertEqual(outdir, t)
+	)).AssertEqual(outdir, t)
 }
 
 func TestGopath(t *testing.T) {
@@ -53,14 +55,104 @@ func TestGopath(t *testing.T) {
 	OrFail(err, t)
 	OrFail(os.Mkdir("temp", 0755), t)
 	defer func() { OrFail(os.RemoveAll("temp"), t) }()
-	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-		return patch.Patches{patch.Replace(pf.File, "koko")}
+	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 	})
 	OrFail(err, t)
-	dir("temp",
+	dir("temp", dir("gopath", dir("mypkg",
 		file("a.go", "koko"),
 		file("a_test.go", "koko"),
-	).AssertEqual("temp", t)
+	))).AssertEqual("temp", t)
+}
+
+func TestPackagePatches(t *testing.T) {
+	fs := dir(
+		"test1",
+		file("a.go", "package test1"), file("b.go", "package test1"), file("c.go", "package test1"),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test1"), t) }()
+	pkg, err := ImportDir("test1", "test1")
+	OrFail(err, t)
+	pkg.SetPackagePatches(func(pkg *patch.PatchablePkg) patch.FilePatches {
+		return patch.FilePatches{
+			patch.AddFile("stub.go", "package test1;func stub()"),
+			patch.ReplaceFile("b.go", "package test1;var b = 1"),
+			patch.RemoveFile("c.go"),
+		}
+	})
+	outdir, err := pkg.Instrument(false, func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
+	})
+	// every output is removed, not the last one alone
+	defer func(outdir string) { OrFail(os.RemoveAll(outdir), t) }(outdir)
+	OrFail(err, t)
+	// added and replaced files are written as they are
+	dir(filepath.Base(outdir), localsDir(t, "test1",
+		file("a.go", "koko"),
+		file("b.go", "package test1;var b = 1"),
+		file("stub.go", "package test1;func stub()"),
+	)).AssertEqual(outdir, t)
+	pkg.SetPackagePatches(func(pkg *patch.PatchablePkg) patch.FilePatches {
+		return patch.FilePatches{patch.AddFile("a.go", "")}
+	})
+	outdir, err = pkg.Instrument(false, func(pf *patch.PatchableFile) (patch.Patches, error) { return nil, nil })
+	defer func(outdir string) { OrFail(os.RemoveAll(outdir), t) }(outdir)
+	if err == nil || err.Error() != "cannot add a.go, package test1 already has it" {
+		t.Error("Expected an error adding an existing file, got", err)
+	}
+	// an error instrumenting a file fails the package
+	pkg.SetPackagePatches(nil)
+	outdir, err = pkg.Instrument(false, func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, fmt.Errorf("cannot patch %s", filepath.Base(pf.FileName))
+	})
+	defer func(outdir string) { OrFail(os.RemoveAll(outdir), t) }(outdir)
+	if err == nil || err.Error() != "cannot patch a.go" {
+		t.Error("Expected the error of the instrumentation, got", err)
+	}
+	// with tests, the package is patched once, with its tests and external tests
+	fs = dir(
+		"test2",
+		file("a.go", "package test2"), file("b.go", "package test2"),
+		file("a_test.go", "package test2"), file("x_test.go", "package test2_test"),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test2"), t) }()
+	pkg, err = ImportDir("test2", "test2")
+	OrFail(err, t)
+	var mu sync.Mutex
+	var calls []string
+	pkg.SetPackagePatches(func(pkg *patch.PatchablePkg) patch.FilePatches {
+		mu.Lock()
+		defer mu.Unlock()
+		var names []string
+		for _, p := range []*patch.PatchablePkg{pkg, pkg.XTest} {
+			var files []string
+			for _, file := range p.Files {
+				files = append(files, filepath.Base(file.FileName))
+			}
+			sort.Strings(files)
+			names = append(names, p.Name+fmt.Sprint(files))
+		}
+		calls = append(calls, strings.Join(names, " "))
+		return patch.FilePatches{
+			patch.AddFile("stub.go", "package test2;func stub()"),
+			patch.ReplaceFile("b.go", "package test2;var b = 1"),
+			patch.RemoveFile("x_test.go"),
+		}
+	})
+	outdir, err = pkg.Instrument(true, func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
+	})
+	defer func(outdir string) { OrFail(os.RemoveAll(outdir), t) }(outdir)
+	OrFail(err, t)
+	expectEq("[test2[a.go a_test.go b.go] test2_test[x_test.go]]", fmt.Sprint(calls), t)
+	dir(filepath.Base(outdir), localsDir(t, "test2",
+		file("a.go", "koko"),
+		file("a_test.go", "koko"),
+		file("b.go", "package test2;var b = 1"),
+		file("stub.go", "package test2;func stub()"),
+	)).AssertEqual(outdir, t)
 }
 
 func TestGuessSubpackage(t *testing.T) {
@@ -81,14 +173,14 @@ func TestGuessSubpackage(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
-			dir("locals", dir("__", dir("sub1", file("sub1.go", "koko")))),
-			file("sub3.go", "koko"),
-		).AssertEqual("temp", t)
+		dir("temp", localsDir(t, "test",
+			dir("sub1", file("sub1.go", "koko")),
+			dir("sub3", file("sub3.go", "koko")),
+		)).AssertEqual("temp", t)
 	}()
 }
 
@@ -103,13 +195,13 @@ func TestDontTakeStdLibByDefault(t *testing.T) {
 	OrFail(err, t)
 	OrFail(os.Mkdir("temp", 0755), t)
 	defer func() { OrFail(os.RemoveAll("temp"), t) }()
-	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-		return patch.Patches{patch.Replace(pf.File, "koko")}
+	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 	})
 	OrFail(err, t)
-	dir("temp",
+	dir("temp", localsDir(t, "test",
 		file("main.go", "koko"),
-	).AssertEqual("temp", t)
+	)).AssertEqual("temp", t)
 }
 
 func TestGuessStdlibPkg(t *testing.T) {
@@ -117,13 +209,13 @@ func TestGuessStdlibPkg(t *testing.T) {
 	OrFail(err, t)
 	OrFail(os.Mkdir("temp", 0755), t)
 	defer func() { OrFail(os.RemoveAll("temp"), t) }()
-	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-		return patch.Patches{patch.Replace(pf.File, "koko")}
+	err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 	})
 	OrFail(err, t)
 	dir("temp",
-		dir("gopath", dir("io", file("io.go", "koko"))),
-		file("ioutil.go", "koko"),
+		dir("gopath", dir("io", file("io.go", "koko"),
+			dir("ioutil", file("ioutil.go", "koko")))),
 	).AssertContains("temp", t)
 }
 
@@ -148,13 +240,15 @@ func TestGuessSubpkgGopath(t *testing.T) {
 		OrFail(err, t)
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
-			file("subsub3.go", "koko"),
-		).AssertEqual("temp", t)
+		// mypkg/sub3 has no .go files, but it is a directory of mypkg, which is the base package
+		dir("temp", dir("gopath", dir("mypkg",
+			dir("sub1", file("sub1.go", "koko")),
+			dir("sub3", dir("subsub3", file("subsub3.go", "koko"))),
+		))).AssertEqual("temp", t)
 	}()
 }
 
@@ -176,17 +270,16 @@ func TestSubDir(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return nil
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return nil, nil
 		})
 		OrFail(err, t)
-		dir("temp",
-			dir("locals",
-				dir("sub1", file("sub1.go", "package sub1")),
-				dir("sub2", file("sub2.go", "package sub2"))),
-			file("base.go", `package test1;import "./locals/sub1"`),
-			file("a_test.go", `package test1;import "./locals/sub2"`),
-		).AssertEqual("temp", t)
+		dir("temp", localsDir(t, "test",
+			dir("sub1", file("sub1.go", "package sub1")),
+			dir("sub2", file("sub2.go", "package sub2")),
+			file("base.go", `package test1;import "./sub1"`),
+			file("a_test.go", `package test1;import "./sub2"`),
+		)).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := ImportDir(".", "test/sub3")
@@ -196,27 +289,28 @@ func TestSubDir(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
-			dir("locals", dir("__", dir("sub1", file("sub1.go", "koko")))),
-			file("sub3.go", "koko"),
-		).AssertEqual("temp", t)
+		dir("temp", localsDir(t, "test",
+			dir("sub1", file("sub1.go", "koko")),
+			dir("sub3", file("sub3.go", "koko")),
+		)).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := ImportDir("./sub3", "test/sub3")
 		OrFail(err, t)
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
-			file("sub3.go", "koko"),
-		).AssertEqual("temp", t)
+		dir("temp", localsDir(t, "test",
+			dir("sub1", file("sub1.go", "koko")),
+			dir("sub3", file("sub3.go", "koko")),
+		)).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := ImportDir(".", "test/sub2")
@@ -226,13 +320,13 @@ func TestSubDir(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
+		dir("temp", localsDir(t, filepath.Join("test", "sub2"),
 			file("sub2.go", "koko"),
-		).AssertEqual("temp", t)
+		)).AssertEqual("temp", t)
 	}()
 }
 
@@ -257,15 +351,15 @@ func TestGopathSubDir(t *testing.T) {
 		OrFail(err, t)
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
 		dir("temp", dir("gopath", dir("mypkg",
 			dir("sub1", file("sub1.go", "koko")),
-			dir("sub2", file("sub2.go", "koko")))),
+			dir("sub2", file("sub2.go", "koko")),
 			file("base.go", "koko"), file("a_test.go", "koko"),
-		).AssertEqual("temp", t)
+		))).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := Import("mypkg", "mypkg/sub3/subsub3")
@@ -275,14 +369,14 @@ func TestGopathSubDir(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return nil
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return nil, nil
 		})
 		OrFail(err, t)
 		dir("temp", dir("gopath", dir("mypkg",
-			dir("sub1", file("sub1.go", "package sub1")))),
-			file("subsub3.go", `package subsub3;import "./gopath/mypkg/sub1"`),
-		).AssertEqual("temp", t)
+			dir("sub1", file("sub1.go", "package sub1")),
+			dir("sub3", dir("subsub3", file("subsub3.go", `package subsub3;import "../../sub1"`))),
+		))).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := Import("mypkg/sub3", "mypkg/sub3/subsub3")
@@ -292,29 +386,108 @@ func TestGopathSubDir(t *testing.T) {
 		}
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
+		dir("temp", dir("gopath", dir("mypkg", dir("sub3", dir("subsub3",
 			file("subsub3.go", "koko"),
-		).AssertEqual("temp", t)
+		))))).AssertEqual("temp", t)
 	}()
 	func() {
 		pkg, err := Import("mypkg", "mypkg/sub2")
 		OrFail(err, t)
 		OrFail(os.Mkdir("temp", 0755), t)
 		defer func() { OrFail(os.RemoveAll("temp"), t) }()
-		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) patch.Patches {
-			return patch.Patches{patch.Replace(pf.File, "koko")}
+		err = pkg.InstrumentTo(true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return patch.Patches{patch.Replace(pf.File, "koko")}, nil
 		})
 		OrFail(err, t)
-		dir("temp",
+		dir("temp", dir("gopath", dir("mypkg", dir("sub2",
 			file("sub2.go", "koko"),
-		).AssertEqual("temp", t)
+		)))).AssertEqual("temp", t)
 	}()
 }
 
+func TestParallelDiamond(t *testing.T) {
+	fs := dir(
+		"gopath/src/mypkg",
+		dir("left", file("left.go", `package left;import "mypkg/bottom"`)),
+		dir("right", file("right.go", `package right;import "mypkg/bottom"`)),
+		dir("bottom", file("bottom.go", "package bottom"), file("bottom2.go", "package bottom")),
+		file("top.go", `package top;import "mypkg/left"`), file("top2.go", `package top;import "mypkg/right"`),
+	)
+	gopath, err := filepath.Abs("gopath")
+	OrFail(err, t)
+	prevgopath := build.Default.GOPATH
+	defer func() { build.Default.GOPATH = prevgopath }()
+	build.Default.GOPATH = gopath
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("gopath"), t) }()
+	pkg, err := Import("mypkg", "mypkg")
+	OrFail(err, t)
+	pkg.SetParallel(3)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	var mu sync.Mutex
+	seen := map[string]int{}
+	err = pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[pf.FileName]++
+		return patch.Patches{patch.Replace(pf.File, "koko")}, nil
+	})
+	OrFail(err, t)
+	if len(seen) != 6 {
+		t.Error("Expected 6 instrumented files, got", seen)
+	}
+	for name, n := range seen {
+		if n != 1 {
+			t.Error(name, "instrumented", n, "times")
+		}
+	}
+	dir("temp", dir("gopath", dir("mypkg",
+		dir("bottom", file("bottom.go", "koko"), file("bottom2.go", "koko")),
+		dir("left", file("left.go", "koko")),
+		dir("right", file("right.go", "koko")),
+		file("top.go", "koko"), file("top2.go", "koko"),
+	))).AssertEqual("temp", t)
+}
+
+func TestInstrumentAll(t *testing.T) {
+	fs := dir(
+		"gopath/src/mypkg",
+		dir("a", file("a.go", `package a`), file("a_test.go", `package a`)),
+		dir("b", file("b.go", `package b;import "mypkg/a"`), file("b_test.go", `package b_test;import "mypkg/b"`)),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("gopath"), t) }()
+	gopath, err := filepath.Abs("gopath")
+	OrFail(err, t)
+	prevgopath := build.Default.GOPATH
+	defer func() { build.Default.GOPATH = prevgopath }()
+	build.Default.GOPATH = gopath
+	var pkgs []*Instrumentable
+	for _, name := range []string{"mypkg/b", "mypkg/a"} {
+		// guessed basepkg is the package itself, mypkg/a is instrumented since it is given
+		pkg, err := Import("", name)
+		OrFail(err, t)
+		pkgs = append(pkgs, pkg)
+	}
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	OrFail(InstrumentAllTo(pkgs, true, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, nil
+	}), t)
+	dir("temp",
+		dir("gopath", dir("mypkg",
+			dir("a", file("a.go", `package a`), file("a_test.go", `package a`)),
+			dir("b", file("b.go", `package b;import "../a"`), file("b_test.go", `package b_test;import "."`)),
+		)),
+	).AssertEqual("temp", t)
+	expectEq(filepath.Join("temp", "gopath", "mypkg", "a"), pkgs[1].OutDir(), t)
+}
+
 func fatalCaller(t *testing.T, depth int, msgs ...interface{}) {
 	_, file, line, ok := runtime.Caller(depth + 1) // +1 to go up fatalCaller's stack
 	if !ok {
@@ -457,3 +630,16 @@ func dir(name string, children ...*Fs) *Fs {
 func file(name, content string) *Fs {
 	return &Fs{name, content, nil}
 }
+
+// localsDir is the tree a package in pkgdir, out of GOPATH, is instrumented to, with the
+// absolute path of pkgdir below locals.
+func localsDir(t *testing.T, pkgdir string, children ...*Fs) *Fs {
+	d, err := filepath.Abs(pkgdir)
+	OrFail(err, t)
+	elems := strings.Split(filepath.ToSlash(d[len(filepath.VolumeName(d)):]), "/")
+	fs := dir(elems[len(elems)-1], children...)
+	for n := len(elems) - 2; n > 0; n-- {
+		fs = dir(elems[n], fs)
+	}
+	return dir("locals", fs)
+}
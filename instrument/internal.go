@@ -0,0 +1,41 @@
+package instrument
+
+import (
+	"go/build"
+	"strings"
+)
+
+// findInternal returns the index of the internal element in the import path, as the go tool finds
+// it, and whether it has one.
+func findInternal(path string) (index int, ok bool) {
+	switch {
+	case strings.HasSuffix(path, "/internal"):
+		return len(path) - len("internal"), true
+	case strings.Contains(path, "/internal/"):
+		return strings.LastIndex(path, "/internal/") + 1, true
+	case path == "internal", strings.HasPrefix(path, "internal/"):
+		return 0, true
+	}
+	return 0, false
+}
+
+// hasPathPrefix reports whether the import path is prefix, or a package below it.
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// visibleInternal reports whether imp, imported by the GOPATH package i, is an internal package
+// i may import. Such packages are instrumented whatever basepkg is, since once i is relocated, only
+// the relocated copy is in the tree the internal package is visible to. Internal packages of the
+// standard library are left alone, they are only visible to it.
+func (i *Instrumentable) visibleInternal(imp string) bool {
+	index, ok := findInternal(imp)
+	if !ok || i.ws != nil || !i.IsInGopath() || build.IsLocalImport(imp) {
+		return false
+	}
+	if !hasPathPrefix(i.pkg.ImportPath, strings.TrimSuffix(imp[:index], "/")) {
+		return false
+	}
+	pkg, err := i.context().Import(imp, i.pkg.Dir, build.FindOnly)
+	return err == nil && !pkg.Goroot && pkg.Root == i.pkg.Root
+}
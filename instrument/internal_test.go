@@ -0,0 +1,86 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestFindInternal(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		exp  string
+	}{
+		{"internal", "0 true"},
+		{"internal/a", "0 true"},
+		{"a/internal", "2 true"},
+		{"a/internal/b/internal/c", "13 true"},
+		{"a/internalb", "0 false"},
+		{"a/b", "0 false"},
+	} {
+		index, ok := findInternal(c.path)
+		expectEq(c.exp, fmt.Sprint(index, ok), t)
+	}
+}
+
+func TestInternalVisibility(t *testing.T) {
+	fs := dir(
+		"gopath/src",
+		dir("a", dir("cmd", file("main.go", `package main;import "a/internal/c"`)),
+			dir("internal", dir("c", file("c.go", "package c")))),
+		dir("b", file("b.go", `package main;import "a/internal/c"`)),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("gopath"), t) }()
+	gopath, err := filepath.Abs("gopath")
+	OrFail(err, t)
+	prevgopath := build.Default.GOPATH
+	defer func() { build.Default.GOPATH = prevgopath }()
+	build.Default.GOPATH = gopath
+	for _, c := range []struct {
+		pkg string
+		exp *Fs
+	}{
+		// a/cmd may import a/internal/c, which must be next to it in the output for that
+		{"a/cmd", dir("a",
+			dir("cmd", file("main.go", `package main;import "../internal/c"`)),
+			dir("internal", dir("c", file("c.go", "package c"))))},
+		// b may not, and the go tool should tell so as it would without gosloppy
+		{"b", dir("b", file("b.go", `package main;import "a/internal/c"`))},
+	} {
+		pkg, err := Import("", c.pkg)
+		OrFail(err, t)
+		OrFail(os.Mkdir("temp", 0755), t)
+		OrFail(pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+			return nil, nil
+		}), t)
+		dir("temp", dir("gopath", c.exp)).AssertEqual("temp", t)
+		OrFail(os.RemoveAll("temp"), t)
+	}
+}
+
+func TestLocalInternal(t *testing.T) {
+	fs := dir(
+		"test",
+		dir("cmd", file("main.go", `package main;import "../internal/y"`)),
+		dir("internal", dir("y", file("y.go", "package y"))),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	pkg, err := ImportDir("", filepath.Join("test", "cmd"))
+	OrFail(err, t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	OrFail(pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, nil
+	}), t)
+	// test/cmd is below the parent of test/internal in the output as well
+	dir("temp", localsDir(t, "test",
+		dir("cmd", file("main.go", `package main;import "../internal/y"`)),
+		dir("internal", dir("y", file("y.go", "package y"))),
+	)).AssertEqual("temp", t)
+}
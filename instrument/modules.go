@@ -0,0 +1,296 @@
+package instrument
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/gosloppy/imports"
+)
+
+// Module is a Go module, rooted at the directory of its go.mod.
+type Module struct {
+	Path string
+	Dir  string
+	// Go is the go version the module declares, if any
+	Go string
+}
+
+// Workspace is the set of modules packages are built in: the modules listed in a go.work file,
+// or the single main module when there is none.
+type Workspace struct {
+	// File is the go.work file, empty for a single module
+	File    string
+	Go      string
+	Modules []*Module
+	// Directives are the lines of go.work to keep in the instrumented workspace, such as replace
+	// directives.
+	Directives []string
+	// Vendor is the vendor directory used with -mod=vendor, if any
+	Vendor string
+}
+
+// rewriteReplaces returns the lines of the go.mod or go.work file with the directories replace
+// directives refer to made absolute, as the file is moved out of dir.
+func rewriteReplaces(data []byte, dir string) []byte {
+	out := new(bytes.Buffer)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		out.WriteString(absReplace(scanner.Text(), dir) + "\n")
+	}
+	return out.Bytes()
+}
+
+// absReplace makes a relative directory after the "=>" of line absolute, relative to dir.
+func absReplace(line, dir string) string {
+	i := strings.Index(line, "=>")
+	if i < 0 {
+		return line
+	}
+	code := line[i+2:]
+	comment := ""
+	if c := strings.Index(code, "//"); c >= 0 {
+		code, comment = code[:c], code[c:]
+	}
+	fields, err := imports.Fields(code)
+	if err != nil || len(fields) == 0 || !imports.IsLocalPath(fields[0]) || filepath.IsAbs(fields[0]) {
+		return line
+	}
+	fields[0] = strconv.Quote(filepath.Join(dir, filepath.FromSlash(fields[0])))
+	return strings.TrimSpace(line[:i+2] + " " + strings.Join(fields, " ") + " " + comment)
+}
+
+// readModule reads the go.mod file in dir.
+func readModule(dir string) (*Module, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	directives, err := imports.ParseDirectives(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, "go.mod"), err)
+	}
+	m := &Module{"", dir, ""}
+	for _, d := range directives {
+		switch {
+		case d.Verb == "module" && len(d.Args) == 1:
+			m.Path = d.Args[0]
+		case d.Verb == "go" && len(d.Args) == 1:
+			m.Go = d.Args[0]
+		}
+	}
+	if m.Path == "" {
+		return nil, errors.New(filepath.Join(dir, "go.mod") + ": no module directive")
+	}
+	return m, nil
+}
+
+// readWorkspace reads the go.work file file.
+func readWorkspace(file string) (*Workspace, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	directives, err := imports.ParseDirectives(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	dir := filepath.Dir(file)
+	w := &Workspace{file, "", nil, nil, findVendor(dir)}
+	for _, d := range directives {
+		switch {
+		case d.Verb == "go" && len(d.Args) == 1:
+			w.Go = d.Args[0]
+		case d.Verb == "use" && len(d.Args) == 1:
+			moddir := filepath.FromSlash(d.Args[0])
+			if !filepath.IsAbs(moddir) {
+				moddir = filepath.Join(dir, moddir)
+			}
+			m, err := readModule(moddir)
+			if err != nil {
+				return nil, err
+			}
+			w.Modules = append(w.Modules, m)
+		case d.Verb == "toolchain" || d.Verb == "godebug":
+			w.Directives = append(w.Directives, d.Verb+" "+d.Line)
+		case d.Verb == "replace":
+			w.Directives = append(w.Directives, "replace "+d.Line)
+		}
+	}
+	return w, nil
+}
+
+// FindWorkspace returns the workspace the go tool builds packages in when run in dir, or nil if
+// it runs in GOPATH mode, or outside any module. As with the go tool, the GO111MODULE and GOWORK
+// environment variables, as imports.Getenv reads them, are respected.
+func FindWorkspace(dir string) (*Workspace, error) {
+	if imports.Getenv("GO111MODULE") == "off" {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if file := imports.FindWork(dir); file != "" {
+		return readWorkspace(file)
+	}
+	if file := imports.FindUp(dir, "go.mod"); file != "" {
+		m, err := readModule(filepath.Dir(file))
+		if err != nil {
+			return nil, err
+		}
+		return &Workspace{"", m.Go, []*Module{m}, nil, findVendor(m.Dir)}, nil
+	}
+	return nil, nil
+}
+
+// ModuleFor returns the workspace module providing the package importpath, or nil if no
+// workspace module does. The module with the longest matching path wins, as nested modules
+// provide the packages below them.
+func (w *Workspace) ModuleFor(importpath string) *Module {
+	var best *Module
+	for _, m := range w.Modules {
+		if (importpath == m.Path || strings.HasPrefix(importpath, m.Path+"/")) && (best == nil || len(m.Path) > len(best.Path)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// ModuleOf returns the workspace module containing the directory dir, or nil.
+func (w *Workspace) ModuleOf(dir string) *Module {
+	var best *Module
+	for _, m := range w.Modules {
+		if (dir == m.Dir || strings.HasPrefix(dir, m.Dir+string(filepath.Separator))) && (best == nil || len(m.Dir) > len(best.Dir)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// importModule imports the package importpath from the workspace module providing it.
+func importModule(ctx *build.Context, w *Workspace, importpath string) (*build.Package, error) {
+	m := w.ModuleFor(importpath)
+	if m == nil {
+		return nil, fmt.Errorf("package %s is not in any workspace module", importpath)
+	}
+	pkg, err := ctx.ImportDir(filepath.Join(m.Dir, filepath.FromSlash(strings.TrimPrefix(importpath, m.Path))), 0)
+	if err != nil {
+		return nil, err
+	}
+	pkg.ImportPath = importpath
+	return pkg, nil
+}
+
+// moduleImportPath gives a package imported from its directory its import path in the workspace.
+// It reports whether the package is in a workspace module.
+func moduleImportPath(w *Workspace, pkg *build.Package) bool {
+	dir, err := filepath.Abs(pkg.Dir)
+	if err != nil {
+		return false
+	}
+	m := w.ModuleOf(dir)
+	if m == nil {
+		return false
+	}
+	rel, err := filepath.Rel(m.Dir, dir)
+	if err != nil {
+		return false
+	}
+	pkg.ImportPath = m.Path
+	if rel != "." {
+		pkg.ImportPath += "/" + filepath.ToSlash(rel)
+	}
+	return true
+}
+
+// goVersionLess compares go versions such as "1.21" and "1.21.3".
+func goVersionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for n := 0; n < len(as) && n < len(bs); n++ {
+		x, errx := strconv.Atoi(as[n])
+		y, erry := strconv.Atoi(bs[n])
+		if errx != nil || erry != nil {
+			return as[n] < bs[n]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// moduleOutpath is the directory, relative to the output, the module dir is instrumented to.
+func moduleOutpath(m *Module) string {
+	return filepath.Join("modules", filepath.FromSlash(m.Path))
+}
+
+// writeWorkspace writes a go.work file to outdir, using the instrumented copies of the modules
+// in instrumented, and the original directories of the other workspace modules. Every
+// instrumented module gets a copy of its go.mod and go.sum. A single module needs no go.work.
+// The vendor directory is mirrored, and then, as the go tool checks the replace directives
+// against vendor/modules.txt, they are kept as they are. Otherwise relative directories in
+// replace directives are made absolute. The files copied are recorded in sm.
+func (w *Workspace) writeWorkspace(outdir string, instrumented map[*Module]bool, sm *SourceMap) error {
+	if w.Vendor != "" {
+		if err := mirrorTree(w.Vendor, filepath.Join(outdir, w.vendorOutpath()), sm); err != nil {
+			return err
+		}
+	}
+	version := w.Go
+	var uses []string
+	for _, m := range w.Modules {
+		if w.File == "" && m.Go != "" && (version == "" || goVersionLess(version, m.Go)) {
+			version = m.Go
+		}
+		if !instrumented[m] {
+			uses = append(uses, strconv.Quote(filepath.ToSlash(m.Dir)))
+			continue
+		}
+		uses = append(uses, "./"+filepath.ToSlash(moduleOutpath(m)))
+		dir := filepath.Join(outdir, moduleOutpath(m))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(m.Dir, "go.mod"))
+		if err != nil {
+			return err
+		}
+		if w.Vendor == "" {
+			data = rewriteReplaces(data, m.Dir)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), data, 0644); err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(m.Dir, "go.sum")); err == nil {
+			sm.AddCopy(filepath.Join(dir, "go.sum"), filepath.Join(m.Dir, "go.sum"))
+			if err := linkOrCopy(filepath.Join(m.Dir, "go.sum"), filepath.Join(dir, "go.sum")); err != nil {
+				return err
+			}
+		}
+	}
+	if w.File == "" {
+		return nil
+	}
+	sort.Strings(uses)
+	out := new(bytes.Buffer)
+	if version != "" {
+		fmt.Fprintf(out, "go %s\n\n", version)
+	}
+	for _, d := range w.Directives {
+		if w.Vendor == "" {
+			d = absReplace(d, filepath.Dir(w.File))
+		}
+		fmt.Fprintln(out, d)
+	}
+	fmt.Fprintf(out, "use (\n\t%s\n)\n", strings.Join(uses, "\n\t"))
+	return ioutil.WriteFile(filepath.Join(outdir, "go.work"), out.Bytes(), 0644)
+}
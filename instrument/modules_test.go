@@ -0,0 +1,124 @@
+package instrument
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestAbsReplace(t *testing.T) {
+	expectEq(`x.com/y => "/src/y" // local`, absReplace(`x.com/y => ../y // local`, "/src/m"), t)
+	expectEq(`x.com/y => x.com/z v1.0.0`, absReplace(`x.com/y => x.com/z v1.0.0`, "/src/m"), t)
+}
+
+func TestInstrumentWorkspace(t *testing.T) {
+	fs := dir(
+		"ws",
+		file("go.work", "go 1.21\n\nuse (\n\t./a\n\t./b\n\t./c\n)\n\nreplace x.com/y => ./y\n"),
+		dir("a", file("go.mod", "module example.com/a\n\ngo 1.21\n"),
+			dir("cmd", file("main.go", `package main;import "example.com/b/lib"`))),
+		dir("b", file("go.mod", "module example.com/b\n\ngo 1.20\n"), file("go.sum", ""),
+			dir("lib", file("lib.go", `package lib;import "x.com/y"`))),
+		dir("c", file("go.mod", "module example.com/c\n")),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("ws"), t) }()
+	gowork, err := filepath.Abs(filepath.Join("ws", "go.work"))
+	OrFail(err, t)
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", gowork)
+	pkg, err := ImportContext(&build.Default, "", "example.com/a/cmd")
+	OrFail(err, t)
+	expectEq("true", fmt.Sprint(pkg.relevantImport("example.com/b/lib")), t)
+	expectEq("false", fmt.Sprint(pkg.relevantImport("x.com/y")), t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	OrFail(pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, nil
+	}), t)
+	wsdir := filepath.Dir(gowork)
+	dir("temp",
+		file("go.work", fmt.Sprintf("go 1.21\n\nreplace x.com/y => %q\nuse (\n\t%q\n\t./modules/example.com/a\n\t./modules/example.com/b\n)\n",
+			filepath.Join(wsdir, "y"), filepath.Join(wsdir, "c"))),
+		dir("modules", dir("example.com",
+			dir("a", file("go.mod", "module example.com/a\n\ngo 1.21\n"),
+				dir("cmd", file("main.go", `package main;import "example.com/b/lib"`))),
+			dir("b", file("go.mod", "module example.com/b\n\ngo 1.20\n"), file("go.sum", ""),
+				dir("lib", file("lib.go", `package lib;import "x.com/y"`))),
+		)),
+	).AssertEqual("temp", t)
+	expectEq(filepath.Join("temp", "modules", "example.com", "a", "cmd"), pkg.OutDir(), t)
+	// the go tool uses the written go.work, not the one GOWORK names
+	written, err := filepath.Abs(filepath.Join("temp", "go.work"))
+	OrFail(err, t)
+	expectEq(written, goEnv(pkg, "GOWORK", t), t)
+}
+
+func TestInstrumentModuleGoWork(t *testing.T) {
+	fs := dir(
+		"ws",
+		file("go.work", "go 1.21\n\nuse ./a\n"),
+		dir("a", file("go.mod", "module example.com/a\n\ngo 1.21\n"),
+			dir("cmd", file("main.go", `package main`))),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("ws"), t) }()
+	gowork, err := filepath.Abs(filepath.Join("ws", "go.work"))
+	OrFail(err, t)
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	pkg, err := ImportDirContext(&build.Default, "", filepath.Join("ws", "a", "cmd"))
+	OrFail(err, t)
+	// a single module is instrumented without a go.work, so the one GOWORK names must not be used
+	t.Setenv("GOWORK", gowork)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	OrFail(pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return nil, nil
+	}), t)
+	expectEq("off", goEnv(pkg, "GOWORK", t), t)
+}
+
+// goEnv returns the value of the go environment variable name, as the go tool building the
+// instrumented pkg sees it.
+func goEnv(pkg *Instrumentable, name string, t *testing.T) string {
+	var out bytes.Buffer
+	cmd := &GoCmd{WorkDir: pkg.OutDir(), Executable: "go", Command: "env", Params: []string{name}, Env: pkg.GoEnv()}
+	r := cmd.Runnable()
+	r.Stdout = &out
+	OrFail(r.Run(), t)
+	return strings.TrimSpace(out.String())
+}
+
+func TestImportWorkspaceOfDir(t *testing.T) {
+	fs := dir(
+		"mod",
+		file("go.mod", "module example.com/mod\n\ngo 1.21\n"),
+		file("mod.go", "package mod"),
+		dir("sub", file("sub.go", `package sub;import "example.com/mod"`)),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("mod"), t) }()
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	// the working directory is in no module, the directory of the package is
+	pkg, err := ImportDirContext(&build.Default, "", filepath.Join("mod", "sub"))
+	OrFail(err, t)
+	expectEq("example.com/mod/sub", pkg.pkg.ImportPath, t)
+	ctx := build.Default
+	ctx.Dir, err = filepath.Abs("mod")
+	OrFail(err, t)
+	pkg, err = ImportContext(&ctx, "", "example.com/mod/sub")
+	OrFail(err, t)
+	expectEq(filepath.Join(ctx.Dir, "sub"), pkg.pkg.Dir, t)
+	// imported packages share the workspace of the package importing them
+	imported, err := pkg.doimport("example.com/mod")
+	OrFail(err, t)
+	expectEq("true", fmt.Sprint(imported.ws == pkg.ws), t)
+}
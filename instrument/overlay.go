@@ -0,0 +1,171 @@
+package instrument
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+// OverlayContext returns a copy of ctx that reads the files overlay has from it, rather than from
+// disk. Packages imported with it have the files of the overlay, and are instrumented as they
+// are there. Files only the overlay has are part of existing directories only.
+func OverlayContext(ctx *build.Context, overlay patch.Overlay) *build.Context {
+	overlay = patch.NewOverlay(overlay)
+	c := *ctx
+	openFile, readDir := ctx.OpenFile, ctx.ReadDir
+	c.OpenFile = func(name string) (io.ReadCloser, error) {
+		if src, ok := overlay.Get(name); ok {
+			if src == nil {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+			}
+			return ioutil.NopCloser(bytes.NewReader(src)), nil
+		}
+		if openFile != nil {
+			return openFile(name)
+		}
+		return os.Open(name)
+	}
+	c.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		var infos []os.FileInfo
+		var err error
+		if readDir != nil {
+			infos, err = readDir(dir)
+		} else {
+			infos, err = ioutil.ReadDir(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		files := map[string]os.FileInfo{}
+		for _, info := range infos {
+			files[info.Name()] = info
+		}
+		for name, src := range overlay {
+			if filepath.Dir(name) != abs {
+				continue
+			}
+			if src == nil {
+				delete(files, filepath.Base(name))
+			} else {
+				files[filepath.Base(name)] = overlayInfo{filepath.Base(name), int64(len(src))}
+			}
+		}
+		infos = infos[:0]
+		for _, info := range files {
+			infos = append(infos, info)
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		return infos, nil
+	}
+	return &c
+}
+
+// overlayInfo describes a file of an overlay in a directory listing.
+type overlayInfo struct {
+	name string
+	size int64
+}
+
+func (info overlayInfo) Name() string       { return info.name }
+func (info overlayInfo) Size() int64        { return info.size }
+func (info overlayInfo) Mode() os.FileMode  { return 0644 }
+func (info overlayInfo) ModTime() time.Time { return time.Time{} }
+func (info overlayInfo) IsDir() bool        { return false }
+func (info overlayInfo) Sys() interface{}   { return nil }
+
+// ReadOverlay reads the overlay of a JSON file given to the -overlay flag of the go tool, which maps
+// file names to files with their content, or to "" for deleted files. Relative names are relative
+// to dir.
+func ReadOverlay(dir, file string) (patch.Overlay, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	overlay := map[string][]byte{}
+	for name, replacement := range config.Replace {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		if replacement == "" {
+			overlay[name] = nil
+			continue
+		}
+		if !filepath.IsAbs(replacement) {
+			replacement = filepath.Join(dir, replacement)
+		}
+		if overlay[name], err = ioutil.ReadFile(replacement); err != nil {
+			return nil, err
+		}
+	}
+	return patch.NewOverlay(overlay), nil
+}
+
+// WriteOverlay writes overlay to dir, as a JSON file for the -overlay flag of the go tool, with
+// the replaced files next to it, and returns the JSON file.
+func WriteOverlay(dir string, overlay patch.Overlay) (string, error) {
+	names := make([]string, 0, len(overlay))
+	for name := range overlay {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var config struct {
+		Replace map[string]string
+	}
+	config.Replace = map[string]string{}
+	for n, name := range names {
+		if overlay[name] == nil {
+			config.Replace[name] = ""
+			continue
+		}
+		// the replacement keeps the base name, which the go tool reports
+		replacement := filepath.Join(dir, "overlay", strconv.Itoa(n), filepath.Base(name))
+		if err := os.MkdirAll(filepath.Dir(replacement), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(replacement, overlay[name], 0644); err != nil {
+			return "", err
+		}
+		config.Replace[name] = replacement
+	}
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, "overlay.json")
+	return file, ioutil.WriteFile(file, data, 0644)
+}
+
+// readFile reads the file with ctx, thus from the overlay of OverlayContext if it has the file.
+func readFile(ctx *build.Context, name string) ([]byte, error) {
+	if ctx.OpenFile == nil {
+		return ioutil.ReadFile(name)
+	}
+	r, err := ctx.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
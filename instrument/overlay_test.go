@@ -0,0 +1,118 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestOverlayContext(t *testing.T) {
+	fs := dir(
+		"test1",
+		file("a.go", "package test1"), file("b.go", "package test1"),
+		dir("sub", file("sub.go", "package sub")),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test1"), t) }()
+	// an unsaved buffer importing a package, a new file, and a deleted one
+	ctx := OverlayContext(&build.Default, patch.Overlay{
+		filepath.Join("test1", "a.go"): []byte(`package test1;import "./sub"`),
+		filepath.Join("test1", "c.go"): []byte("package test1;var c = 1"),
+		filepath.Join("test1", "b.go"): nil,
+	})
+	pkg, err := ImportDirContext(ctx, "", "test1")
+	OrFail(err, t)
+	expectEq("[a.go c.go] [./sub]", fmt.Sprint(pkg.Package().GoFiles, pkg.Package().Imports), t)
+	outdir, err := pkg.Instrument(false, func(pf *patch.PatchableFile) (patch.Patches, error) { return nil, nil })
+	defer func() { OrFail(os.RemoveAll(outdir), t) }()
+	OrFail(err, t)
+	dir(filepath.Base(outdir), localsDir(t, "test1",
+		file("a.go", `package test1;import "./sub"`),
+		file("c.go", "package test1;var c = 1"),
+		dir("sub", file("sub.go", "package sub")),
+	)).AssertEqual(outdir, t)
+}
+
+func TestReadOverlay(t *testing.T) {
+	fs := dir(
+		"test1",
+		file("overlay.json", `{"Replace": {"a.go": "buffer.go", "b.go": ""}}`),
+		file("buffer.go", "package test1"),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test1"), t) }()
+	wd, err := os.Getwd()
+	OrFail(err, t)
+	overlay, err := ReadOverlay(filepath.Join(wd, "test1"), "overlay.json")
+	OrFail(err, t)
+	src, ok := overlay.Get(filepath.Join("test1", "a.go"))
+	expectEq("true package test1", fmt.Sprint(ok, " ", string(src)), t)
+	src, ok = overlay.Get(filepath.Join(wd, "test1", "b.go"))
+	expectEq("true true", fmt.Sprint(src == nil, ok), t)
+}
+
+func TestGoCmdOverlay(t *testing.T) {
+	fs := dir(
+		"test1",
+		file("overlay.json", `{"Replace": {"a.go": "buffer.go"}}`),
+		file("a.go", "package test1;import \"fmt\""),
+		file("buffer.go", "package test1"),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test1"), t) }()
+	cmd, err := NewGoCmd("test1", "go", "build", "-overlay", "overlay.json", "-v")
+	OrFail(err, t)
+	// gosloppy applies the overlay, the go tool compiles the instrumented files
+	expectEq("v=true", fmt.Sprint(cmd.BuildFlags), t)
+	pkg, err := ImportDirContext(cmd.Context(), "", "test1")
+	OrFail(err, t)
+	expectEq("[]", fmt.Sprint(pkg.Package().Imports), t)
+}
+
+func TestGoOverlay(t *testing.T) {
+	fs := dir(
+		"test1",
+		file("a.go", "package test1"),
+		file("data.txt", "disk"),
+		dir("other", file("b.go", "package other")),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test1"), t) }()
+	wd, err := os.Getwd()
+	OrFail(err, t)
+	// an instrumented file, an embedded file copied to the output, and a file of another package
+	overlay := patch.NewOverlay(map[string][]byte{
+		filepath.Join("test1", "a.go"):          []byte("package test1;import _ \"embed\"\n//go:embed data.txt\nvar data string"),
+		filepath.Join("test1", "data.txt"):      []byte("buffer"),
+		filepath.Join("test1", "other", "b.go"): nil,
+	})
+	pkg, err := ImportDirContext(OverlayContext(&build.Default, overlay), "", "test1")
+	OrFail(err, t)
+	outdir, err := pkg.Instrument(false, func(pf *patch.PatchableFile) (patch.Patches, error) { return nil, nil })
+	defer func() { OrFail(os.RemoveAll(outdir), t) }()
+	OrFail(err, t)
+	out, err := filepath.Abs(pkg.OutDir())
+	OrFail(err, t)
+	goOverlay := pkg.SourceMap().GoOverlay(overlay)
+	expectEq(fmt.Sprint(map[string]string{
+		filepath.Join(out, "data.txt"):              "buffer",
+		filepath.Join(wd, "test1", "other", "b.go"): "",
+	}), fmt.Sprint(stringOverlay(goOverlay)), t)
+	file, err := WriteOverlay(outdir, goOverlay)
+	OrFail(err, t)
+	written, err := ReadOverlay(outdir, file)
+	OrFail(err, t)
+	expectEq(fmt.Sprint(stringOverlay(goOverlay)), fmt.Sprint(stringOverlay(written)), t)
+}
+
+func stringOverlay(overlay patch.Overlay) map[string]string {
+	m := map[string]string{}
+	for name, src := range overlay {
+		m[name] = string(src)
+	}
+	return m
+}
@@ -0,0 +1,186 @@
+package instrument
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IsPattern reports whether the package argument is a pattern, such as "./..." or "net/...".
+func IsPattern(arg string) bool {
+	return strings.Contains(arg, "...")
+}
+
+// MatchPackages expands the package patterns given to the go tool into the packages they match.
+// Local patterns, such as "./...", expand to local paths relative to workdir, and import path
+// patterns to import paths, which in module mode match the packages of the workspace modules.
+// Arguments that are not patterns are returned as is, and patterns matching no packages are
+// returned as unmatched.
+// As with the go tool, directories starting with "." or "_", testdata and vendor are skipped.
+func MatchPackages(ctx *build.Context, workdir string, args []string) (pkgs, unmatched []string, err error) {
+	seen := map[string]bool{}
+	add := func(pkg string) {
+		if !seen[pkg] {
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	for _, arg := range args {
+		if !IsPattern(arg) {
+			add(arg)
+			continue
+		}
+		var matches []string
+		var err error
+		if build.IsLocalImport(arg) {
+			matches, err = matchLocal(ctx, workdir, arg)
+		} else if ws, werr := FindWorkspace(workdir); werr != nil {
+			err = werr
+		} else if ws != nil {
+			matches, err = matchModules(ctx, ws, arg)
+		} else {
+			matches, err = matchImportPath(ctx, arg)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(matches) == 0 {
+			unmatched = append(unmatched, arg)
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+	return pkgs, unmatched, nil
+}
+
+// matchPattern returns a function matching package paths against pattern, where "..." matches
+// any string, and "x/..." matches x as well.
+func matchPattern(pattern string) func(name string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	reg := regexp.MustCompile(`^` + re + `$`)
+	return reg.MatchString
+}
+
+// patternRoot returns the longest directory prefix of pattern with no "...".
+func patternRoot(pattern string) string {
+	root := pattern[:strings.Index(pattern, "...")]
+	if i := strings.LastIndex(root, "/"); i >= 0 {
+		return root[:i]
+	}
+	return ""
+}
+
+func matchLocal(ctx *build.Context, workdir, pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	match := matchPattern(pattern)
+	root := patternRoot(pattern)
+	if root == "" {
+		root = "."
+	}
+	var pkgs []string
+	err := walkPackages(ctx, filepath.Join(workdir, root), func(dir string) {
+		rel, err := filepath.Rel(workdir, dir)
+		if err != nil {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		if !match(rel) {
+			return
+		}
+		if rel != "." && !strings.HasPrefix(rel, "../") {
+			rel = "./" + rel
+		}
+		pkgs = append(pkgs, rel)
+	})
+	return pkgs, err
+}
+
+func matchImportPath(ctx *build.Context, pattern string) ([]string, error) {
+	match := matchPattern(pattern)
+	root := patternRoot(pattern)
+	var pkgs []string
+	for _, src := range ctx.SrcDirs() {
+		start := filepath.Join(src, filepath.FromSlash(root))
+		if _, err := os.Stat(start); err != nil {
+			continue
+		}
+		err := walkPackages(ctx, start, func(dir string) {
+			rel, err := filepath.Rel(src, dir)
+			if err != nil || rel == "." {
+				return
+			}
+			if rel = filepath.ToSlash(rel); match(rel) {
+				pkgs = append(pkgs, rel)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
+
+// matchModules matches an import path pattern against the packages of the workspace modules.
+func matchModules(ctx *build.Context, ws *Workspace, pattern string) ([]string, error) {
+	match := matchPattern(pattern)
+	root := patternRoot(pattern)
+	var pkgs []string
+	for _, m := range ws.Modules {
+		start := m.Dir
+		if strings.HasPrefix(root, m.Path+"/") {
+			start = filepath.Join(m.Dir, filepath.FromSlash(strings.TrimPrefix(root, m.Path+"/")))
+		} else if root != m.Path && !strings.HasPrefix(m.Path, root) {
+			continue
+		}
+		if _, err := os.Stat(start); err != nil {
+			continue
+		}
+		err := walkPackages(ctx, start, func(dir string) {
+			rel, err := filepath.Rel(m.Dir, dir)
+			if err != nil || ws.ModuleOf(dir) != m {
+				// nested modules provide their own packages
+				return
+			}
+			importpath := m.Path
+			if rel != "." {
+				importpath += "/" + filepath.ToSlash(rel)
+			}
+			if match(importpath) {
+				pkgs = append(pkgs, importpath)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
+
+// walkPackages calls f with every directory below root, including root, containing a Go package.
+func walkPackages(ctx *build.Context, root string, f func(dir string)) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if path != root {
+			name := info.Name()
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" {
+				return filepath.SkipDir
+			}
+		}
+		if _, err := ctx.ImportDir(path, 0); err != nil {
+			if _, ok := err.(*build.NoGoError); ok {
+				return nil
+			}
+		}
+		f(path)
+		return nil
+	})
+}
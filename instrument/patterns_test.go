@@ -0,0 +1,33 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"testing"
+)
+
+func TestMatchPackages(t *testing.T) {
+	fs := dir(
+		"test",
+		file("a.go", "package test"),
+		dir("sub1", file("sub1.go", "package sub1"), dir("testdata", file("x.go", "package x"))),
+		dir("sub2", dir("subsub", file("subsub.go", "package subsub"))),
+		dir("_ignored", file("i.go", "package i")),
+		dir("empty", file("README", "")),
+	)
+	OrFail(fs.Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	pkgs, unmatched, err := MatchPackages(&build.Default, "test", []string{"./...", "./sub1", "fmt"})
+	OrFail(err, t)
+	expectEq("[. ./sub1 ./sub2/subsub fmt] []", fmt.Sprint(pkgs, " ", unmatched), t)
+	pkgs, unmatched, err = MatchPackages(&build.Default, "test", []string{"./sub2/...", "./empty/..."})
+	OrFail(err, t)
+	expectEq("[./sub2/subsub] [./empty/...]", fmt.Sprint(pkgs, " ", unmatched), t)
+	pkgs, _, err = MatchPackages(&build.Default, ".", []string{"./test/sub..."})
+	OrFail(err, t)
+	expectEq("[./test/sub1 ./test/sub2/subsub]", fmt.Sprint(pkgs), t)
+	pkgs, _, err = MatchPackages(&build.Default, ".", []string{"container/..."})
+	OrFail(err, t)
+	expectEq("[container/heap container/list container/ring]", fmt.Sprint(pkgs), t)
+}
@@ -0,0 +1,316 @@
+package instrument
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+// SourceMap maps files and directories written during instrumentation back to the original
+// sources they were generated from.
+type SourceMap struct {
+	mu    sync.Mutex
+	files map[string]*mappedFile
+	dirs  map[string]string
+	// sorted are the keys of dirs, as sortedDirs returns them, nil until it is called
+	sorted []string
+	// importpaths has the import path of original packages in GOPATH, by their directory, and
+	// pkgdirs the instrumented directories, by the import path
+	importpaths map[string]string
+	pkgdirs     map[string]string
+	// copies are the files copied to the output unchanged, by their original files
+	copies map[string]string
+}
+
+type mappedFile struct {
+	orig   string
+	posmap *patch.PosMap
+	// linedirectives is set if the patched file has line directives
+	linedirectives bool
+}
+
+func NewSourceMap() *SourceMap {
+	return &SourceMap{
+		files:       make(map[string]*mappedFile),
+		dirs:        make(map[string]string),
+		importpaths: make(map[string]string),
+		pkgdirs:     make(map[string]string),
+		copies:      make(map[string]string),
+	}
+}
+
+func abs(path string) string {
+	if p, err := filepath.Abs(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// AddFile records that patched was generated from orig, with posmap mapping positions between them.
+// linedirectives is set if patched has line directives, see patch.PatchableFile.
+func (sm *SourceMap) AddFile(patched, orig string, posmap *patch.PosMap, linedirectives bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.files[abs(patched)] = &mappedFile{abs(orig), posmap, linedirectives}
+}
+
+// hasLineDirectives reports whether the instrumented file patched has line directives.
+func (sm *SourceMap) hasLineDirectives(patched string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	f, ok := sm.files[abs(patched)]
+	return ok && f.linedirectives
+}
+
+// AddDir records that the package at patched directory was generated from the orig directory.
+// importpath is the import path of the original package, empty if it is not in GOPATH.
+func (sm *SourceMap) AddDir(patched, orig, importpath string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.dirs[abs(patched)] = abs(orig)
+	sm.sorted = nil
+	if importpath != "" {
+		sm.importpaths[abs(orig)] = importpath
+		sm.pkgdirs[importpath] = abs(patched)
+	}
+}
+
+// AddCopy records that the file copy was linked or copied, unchanged, from orig.
+func (sm *SourceMap) AddCopy(copy, orig string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.copies[abs(orig)] = abs(copy)
+}
+
+// GoOverlay returns what the go tool building the output needs of overlay: the files the
+// instrumentation did not write, which it read from overlay, with the files copied to the output
+// named by their copies.
+func (sm *SourceMap) GoOverlay(overlay patch.Overlay) patch.Overlay {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	written := map[string]bool{}
+	for _, f := range sm.files {
+		written[f.orig] = true
+	}
+	o := patch.Overlay{}
+	for name, src := range overlay {
+		if copy, ok := sm.copies[name]; ok {
+			o[copy] = src
+		} else if !written[name] {
+			o[name] = src
+		}
+	}
+	return o
+}
+
+// Original returns the original position of pos, which is a position in an instrumented file.
+// ok is false if pos.Filename was not generated by the instrumentation.
+func (sm *SourceMap) Original(pos token.Position) (orig token.Position, ok bool) {
+	sm.mu.Lock()
+	f, ok := sm.files[abs(pos.Filename)]
+	sm.mu.Unlock()
+	if !ok {
+		return pos, false
+	}
+	orig = f.posmap.ToOriginal(pos)
+	orig.Filename = f.orig
+	if pos.Column == 0 {
+		orig.Column = 0
+	}
+	return orig, true
+}
+
+func (sm *SourceMap) isOriginal(path string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, f := range sm.files {
+		if f.orig == path {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginalDir returns the original directory of an instrumented package directory, or of
+// a file below it.
+func (sm *SourceMap) OriginalDir(path string) (string, bool) {
+	path = abs(path)
+	for _, dir := range sm.sortedDirs() {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			sm.mu.Lock()
+			defer sm.mu.Unlock()
+			return sm.dirs[dir] + path[len(dir):], true
+		}
+	}
+	return path, false
+}
+
+// sortedDirs returns the instrumented directories, nested directories first. They are sorted once
+// the instrumentation is done, rather than for every line rewritten.
+func (sm *SourceMap) sortedDirs() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.sorted == nil {
+		sm.sorted = make([]string, 0, len(sm.dirs))
+		for dir := range sm.dirs {
+			sm.sorted = append(sm.sorted, dir)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(sm.sorted)))
+	}
+	return sm.sorted
+}
+
+// fileLineRe matches file:line and file:line:col references, as printed by the go tool,
+// the compiler, panics and the testing package
+var fileLineRe = regexp.MustCompile(`((?:[A-Za-z]:)?[^\s:"'()\[\]]+\.go):(\d+)(?::(\d+))?`)
+
+// RewriteLine rewrites all references to instrumented files in line to the original sources.
+// Relative paths in line are relative to dir.
+func (sm *SourceMap) RewriteLine(line, dir string) string {
+	line = fileLineRe.ReplaceAllStringFunc(line, func(match string) string {
+		m := fileLineRe.FindStringSubmatch(match)
+		path := m[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		pos := token.Position{Filename: path}
+		pos.Line, _ = strconv.Atoi(m[2])
+		if m[3] != "" {
+			pos.Column, _ = strconv.Atoi(m[3])
+		}
+		orig, ok := sm.Original(pos)
+		if !ok && sm.isOriginal(path) {
+			// already points to the original file, due to line directives
+			orig, ok = pos, true
+		}
+		if !ok {
+			return match
+		}
+		name := displayPath(orig.Filename)
+		if !strings.ContainsAny(m[1], `/\`) {
+			// the testing package reports bare file names
+			name = filepath.Base(orig.Filename)
+		}
+		if orig.Column == 0 {
+			return fmt.Sprintf("%s:%d", name, orig.Line)
+		}
+		return fmt.Sprintf("%s:%d:%d", name, orig.Line, orig.Column)
+	})
+	for _, dir := range sm.sortedDirs() {
+		if strings.Contains(line, dir) {
+			orig, _ := sm.OriginalDir(dir)
+			line = strings.Replace(line, dir, orig, -1)
+		}
+	}
+	return line
+}
+
+// displayPath returns path relative to the current directory, the way the go tool prints it,
+// if path is below the current directory.
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return "." + string(filepath.Separator) + rel
+	}
+	return path
+}
+
+// Rewriter is an io.Writer that rewrites references to instrumented files to the original
+// sources, line by line. Call Flush to write the last, incomplete, line.
+type Rewriter struct {
+	mu  sync.Mutex
+	sm  *SourceMap
+	w   io.Writer
+	dir string
+	buf []byte
+	// json is set for the output of test2json, a JSON event per line
+	json bool
+}
+
+// Rewriter returns a writer that writes to w, replacing references to instrumented files.
+// Relative paths written to it are relative to dir.
+func (sm *SourceMap) Rewriter(w io.Writer, dir string) *Rewriter {
+	return &Rewriter{sm: sm, w: w, dir: dir}
+}
+
+// JSONRewriter returns a Rewriter for the output of test2json, which rewrites the Output of every
+// event, as paths in the encoded output would end at its escapes.
+func (sm *SourceMap) JSONRewriter(w io.Writer, dir string) *Rewriter {
+	return &Rewriter{sm: sm, w: w, dir: dir, json: true}
+}
+
+func (r *Rewriter) rewrite(line string) string {
+	if r.json {
+		return r.sm.RewriteEvent(line, r.dir)
+	}
+	return r.sm.RewriteLine(line, r.dir)
+}
+
+// RewriteEvent rewrites references to instrumented files in the Output of the test2json event
+// line, leaving the rest of the event as is. Lines that are not events are rewritten as text.
+func (sm *SourceMap) RewriteEvent(line, dir string) string {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return sm.RewriteLine(line, dir)
+	}
+	var output string
+	if err := json.Unmarshal(event["Output"], &output); err != nil {
+		return line
+	}
+	original := sm.RewriteLine(output, dir)
+	if original == output {
+		return line
+	}
+	rewritten, err := json.Marshal(original)
+	if err != nil {
+		return line
+	}
+	// Output is the last field test2json writes
+	i := strings.LastIndex(line, string(event["Output"]))
+	if i < 0 {
+		return line
+	}
+	return line[:i] + string(rewritten) + line[i+len(event["Output"]):]
+}
+
+func (r *Rewriter) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, b...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if _, err := io.WriteString(r.w, r.rewrite(string(r.buf[:i+1]))); err != nil {
+			return len(b), err
+		}
+		r.buf = r.buf[i+1:]
+	}
+}
+
+// Flush writes any buffered incomplete line.
+func (r *Rewriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, r.rewrite(string(r.buf)))
+	r.buf = nil
+	return err
+}
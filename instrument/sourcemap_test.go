@@ -0,0 +1,123 @@
+package instrument
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestSourceMapRewrite(t *testing.T) {
+	OrFail(dir("test", file("a.go", "package main;func main() { a := 1 }")).Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	pkg, err := ImportDir("", "test")
+	OrFail(err, t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	err = pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Insert(pf.File.Decls[0].Pos(), "var _ = 1;")}, nil
+	})
+	OrFail(err, t)
+	sm := pkg.SourceMap()
+	out, err := filepath.Abs(pkg.OutDir())
+	OrFail(err, t)
+	orig, err := filepath.Abs("test")
+	OrFail(err, t)
+	for _, c := range []struct{ line, exp string }{
+		{"./a.go:1:38: a declared and not used\n", "./test/a.go:1:28: a declared and not used\n"},
+		{"\t" + filepath.Join(out, "a.go") + ":1 +0x1d\n", "\t./test/a.go:1 +0x1d\n"},
+		{"    a.go:1: failed\n", "    a.go:1: failed\n"},
+		{"# _" + out + "\n", "# _" + orig + "\n"},
+		{"./b.go:1:3: untouched\n", "./b.go:1:3: untouched\n"},
+	} {
+		expectEq(c.exp, sm.RewriteLine(c.line, out), t)
+	}
+	buf := new(bytes.Buffer)
+	w := sm.Rewriter(buf, out)
+	w.Write([]byte("./a.go:1"))
+	w.Write([]byte(":38: x\n./a.go:1:1"))
+	expectEq("./test/a.go:1:28: x\n", buf.String(), t)
+	OrFail(w.Flush(), t)
+	expectEq("./test/a.go:1:28: x\n./test/a.go:1:1", buf.String(), t)
+	// test2json escapes the tab of panic frames, the output is rewritten decoded
+	frame, err := json.Marshal("\t" + filepath.Join(out, "a.go") + ":1 +0x1d\n")
+	OrFail(err, t)
+	buf.Reset()
+	w = sm.JSONRewriter(buf, out)
+	w.Write([]byte(`{"Action":"output","Package":"test","Test":"TestA","Output":` + string(frame) + "}\n"))
+	w.Write([]byte(`{"Action":"output","Package":"test","Output":"FAIL\n"}` + "\n"))
+	w.Write([]byte("./a.go:1:38: a declared and not used\n"))
+	OrFail(w.Flush(), t)
+	expectEq(`{"Action":"output","Package":"test","Test":"TestA","Output":"\t./test/a.go:1 +0x1d\n"}`+"\n"+
+		`{"Action":"output","Package":"test","Output":"FAIL\n"}`+"\n"+
+		"./test/a.go:1:28: a declared and not used\n", buf.String(), t)
+}
+
+func TestRewriteCoverProfile(t *testing.T) {
+	OrFail(dir("test", file("a.go", "package main\nfunc main() {\n\tprintln(1)\n}\n")).Build("."), t)
+	defer func() { OrFail(os.RemoveAll("test"), t) }()
+	pkg, err := ImportDir("", "test")
+	OrFail(err, t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	defer func() { OrFail(os.RemoveAll("temp"), t) }()
+	err = pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Insert(pf.File.Decls[0].Pos(), "func init() {\n}\n")}, nil
+	})
+	OrFail(err, t)
+	out, err := filepath.Abs(pkg.OutDir())
+	OrFail(err, t)
+	orig, err := filepath.Abs("test")
+	OrFail(err, t)
+	profile := "mode: set\n" +
+		"_" + filepath.Join(out, "a.go") + ":2.13,3.2 0 1\n" +
+		"_" + filepath.Join(out, "a.go") + ":4.13,6.2 1 1\n" +
+		"other/b.go:1.1,2.2 1 0\n"
+	buf := new(bytes.Buffer)
+	OrFail(pkg.SourceMap().RewriteCoverProfile(bytes.NewBufferString(profile), buf), t)
+	expectEq("mode: set\n"+
+		filepath.ToSlash(filepath.Join(orig, "a.go"))+":2.13,4.2 1 1\n"+
+		"other/b.go:1.1,2.2 1 0\n", buf.String(), t)
+	// with line directives, cmd/cover reports the original positions of the instrumented file
+	pkg.SetLineDirectives(true)
+	OrFail(os.RemoveAll("temp"), t)
+	OrFail(os.Mkdir("temp", 0755), t)
+	err = pkg.InstrumentTo(false, "temp", func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Insert(pf.File.Decls[0].Pos(), "func init() {\n}\n")}, nil
+	})
+	OrFail(err, t)
+	profile = "mode: set\n" +
+		"_" + filepath.Join(out, "a.go") + ":2.13,4.2 1 1\n"
+	buf.Reset()
+	OrFail(pkg.SourceMap().RewriteCoverProfile(bytes.NewBufferString(profile), buf), t)
+	expectEq("mode: set\n"+
+		filepath.ToSlash(filepath.Join(orig, "a.go"))+":2.13,4.2 1 1\n", buf.String(), t)
+}
+
+func TestRewriteCoverProfileModule(t *testing.T) {
+	// in module mode, files are named by the import path, the same for the instrumented package
+	root := t.TempDir()
+	OrFail(dir("m", file("go.mod", "module example.com/m\n"),
+		dir("lib", file("lib.go", "package lib\n\nfunc F() { x := 1; println(x) }\n"))).Build(root), t)
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	t.Chdir(filepath.Join(root, "m"))
+	pkg, err := ImportContext(&build.Default, "", "example.com/m/lib")
+	OrFail(err, t)
+	err = pkg.InstrumentTo(false, filepath.Join(root, "out"), func(pf *patch.PatchableFile) (patch.Patches, error) {
+		x := pf.File.Decls[0].(*ast.FuncDecl).Body.List[0]
+		return patch.Patches{patch.Insert(x.End(), "; _ = x")}, nil
+	})
+	OrFail(err, t)
+	// the inserted statement is neither counted nor moves the end of the block
+	profile := "mode: set\n" +
+		"example.com/m/lib/lib.go:3.10,3.39 3 1\n"
+	buf := new(bytes.Buffer)
+	OrFail(pkg.SourceMap().RewriteCoverProfile(bytes.NewBufferString(profile), buf), t)
+	expectEq("mode: set\n"+
+		"example.com/m/lib/lib.go:3.10,3.32 2 1\n", buf.String(), t)
+}
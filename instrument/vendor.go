@@ -0,0 +1,137 @@
+package instrument
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isVendorPath reports whether the GOPATH import path is of a package in a vendor directory.
+func isVendorPath(importpath string) bool {
+	return strings.HasPrefix(importpath, "vendor/") || strings.Contains(importpath, "/vendor/")
+}
+
+// vendoredOutpath returns the output path of a vendored GOPATH package. The go tool refuses local
+// imports through a vendor directory, so the vendor element of the path is renamed.
+func vendoredOutpath(importpath string) string {
+	elems := strings.Split(importpath, "/")
+	for n, elem := range elems {
+		if elem == "vendor" {
+			elems[n] = "_vendor"
+		}
+	}
+	return filepath.Join("gopath", filepath.Join(elems...))
+}
+
+// findVendor returns the vendor directory in dir the go tool uses with -mod=vendor, or "".
+func findVendor(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, "vendor", "modules.txt")); err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "vendor")
+}
+
+// vendorOutpath returns the path, relative to the output, the vendor directory is mirrored to.
+// A workspace is vendored next to its go.work, a single module next to its go.mod.
+func (w *Workspace) vendorOutpath() string {
+	if w.File != "" {
+		return "vendor"
+	}
+	return filepath.Join(moduleOutpath(w.Modules[0]), "vendor")
+}
+
+// vendoredDir returns the directory of the vendored package importpath, or "" if it is not vendored.
+func (w *Workspace) vendoredDir(importpath string) string {
+	if w.Vendor == "" || w.ModuleFor(importpath) != nil {
+		return ""
+	}
+	dir := filepath.Join(w.Vendor, filepath.FromSlash(importpath))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// SetVendor makes vendored packages the package imports instrumented as well. By default they
+// are copied as they are, since vendored third party code is not ours to be sloppy in.
+func (i *Instrumentable) SetVendor(on bool) {
+	i.vendor = on
+}
+
+// isVendored reports whether the package is vendored.
+func (i *Instrumentable) isVendored() bool {
+	if i.ws == nil {
+		return isVendorPath(i.pkg.ImportPath)
+	}
+	return i.ws.Vendor != "" && strings.HasPrefix(i.pkg.Dir, i.ws.Vendor+string(filepath.Separator))
+}
+
+// vendoredImport returns the package imp resolves to from i through a vendor directory, as an
+// import path for GOPATH packages, or imp itself for modules, or "" if imp is not vendored.
+// Results are cached, as imports are resolved again when rewritten.
+func (in *instrumenter) vendoredImport(i *Instrumentable, imp string) string {
+	if build.IsLocalImport(imp) || i.pkg.Dir == "" {
+		return ""
+	}
+	if i.ws != nil {
+		if i.ws.vendoredDir(imp) == "" {
+			return ""
+		}
+		return imp
+	}
+	key := i.pkg.Dir + "\x00" + imp
+	in.vendormu.Lock()
+	defer in.vendormu.Unlock()
+	if path, ok := in.vendored[key]; ok {
+		return path
+	}
+	path := ""
+	if pkg, err := i.context().Import(imp, i.pkg.Dir, build.FindOnly); err == nil && isVendorPath(pkg.ImportPath) {
+		path = pkg.ImportPath
+	}
+	in.vendored[key] = path
+	return path
+}
+
+// importVendored imports the package vendored imp, imported by i, resolves to.
+func (i *Instrumentable) importVendored(imp string) (*Instrumentable, error) {
+	var pkg *build.Package
+	var err error
+	if i.ws != nil {
+		pkg, err = i.context().ImportDir(i.ws.vendoredDir(imp), 0)
+		if pkg != nil {
+			pkg.ImportPath = imp
+		}
+	} else {
+		pkg, err = i.context().Import(imp, i.pkg.Dir, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Instrumentable{pkg: pkg, basepkg: i.basepkg, why: i.why, ctx: i.ctx, ws: i.ws, vendor: i.vendor}, nil
+}
+
+// mirrorTree links every file below src into dst, unless dst already has it, and records the
+// copies in sm.
+func mirrorTree(src, dst string, sm *SourceMap) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Lstat(target); err == nil {
+			// instrumented
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		sm.AddCopy(target, path)
+		return linkOrCopy(path, target)
+	})
+}
@@ -0,0 +1,53 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/patch"
+)
+
+func TestInstrumentVendoredModule(t *testing.T) {
+	fs := dir(
+		"mv",
+		file("go.mod", "module example.com/app\n\ngo 1.21\n\nrequire x.com/dep v1.0.0\n"),
+		dir("cmd", file("main.go", `package main;import "x.com/dep"`)),
+		dir("vendor", file("modules.txt", "# x.com/dep v1.0.0\n## explicit; go 1.21\nx.com/dep\n"),
+			dir("x.com", dir("dep", file("dep.go", `package dep;import "os"`)))),
+	)
+	OrFail(fs.Build("."), t)
+	root, err := filepath.Abs("mv")
+	OrFail(err, t)
+	defer func() { OrFail(os.RemoveAll(root), t) }()
+	t.Setenv("GO111MODULE", "on")
+	t.Setenv("GOWORK", "off")
+	temp, err := filepath.Abs("temp")
+	OrFail(err, t)
+	// as the go tool, the module is found from the working directory
+	t.Chdir(filepath.Join("mv", "cmd"))
+	mark := func(pf *patch.PatchableFile) (patch.Patches, error) {
+		return patch.Patches{patch.Insert(pf.File.Name.End(), "/**/")}, nil
+	}
+	for _, vendor := range []bool{false, true} {
+		pkg, err := ImportDirContext(&build.Default, "", ".")
+		OrFail(err, t)
+		pkg.SetVendor(vendor)
+		expectEq("false", fmt.Sprint(pkg.relevantImport("x.com/dep")), t)
+		OrFail(os.Mkdir(temp, 0755), t)
+		OrFail(pkg.InstrumentTo(false, temp, mark), t)
+		dep := `package dep;import "os"`
+		if vendor {
+			dep = `package dep/**/;import "os"`
+		}
+		dir("temp", dir("modules", dir("example.com", dir("app",
+			file("go.mod", "module example.com/app\n\ngo 1.21\n\nrequire x.com/dep v1.0.0\n"),
+			dir("cmd", file("main.go", `package main/**/;import "x.com/dep"`)),
+			dir("vendor", file("modules.txt", "# x.com/dep v1.0.0\n## explicit; go 1.21\nx.com/dep\n"),
+				dir("x.com", dir("dep", file("dep.go", dep)))),
+		)))).AssertEqual(temp, t)
+		OrFail(os.RemoveAll(temp), t)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+// importPackages imports the packages given on the command line: the package of the .go files
+// given, as for go run, the packages matched by the packages and patterns given, or the package
+// in the working directory.
+func importPackages(gocmd *instrument.GoCmd, opts *options) []*instrument.Instrumentable {
+	ctx := gocmd.Context()
+	if gocmd.Command == "run" || gocmd.HasFiles() {
+		return []*instrument.Instrumentable{instrument.ImportFilesContext(ctx, opts.basedir, gocmd.Params...)}
+	}
+	params := gocmd.Params
+	if len(params) == 0 {
+		params = []string{"."}
+	}
+	var pkgs []*instrument.Instrumentable
+	for _, param := range matchPackages(gocmd, params) {
+		pkg, err := importPackage(ctx, opts.basedir, gocmd.WorkDir, param)
+		die(err)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// importPackage imports a package given on the command line, either by import path or as a
+// path relative to workdir.
+func importPackage(ctx *build.Context, basedir, workdir, arg string) (*instrument.Instrumentable, error) {
+	if !build.IsLocalImport(arg) {
+		return instrument.ImportContext(ctx, basedir, arg)
+	}
+	dir, err := filepath.Abs(filepath.Join(workdir, arg))
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := ctx.ImportDir(dir, build.FindOnly)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.ImportPath != "." && pkg.ImportPath != "" {
+		return instrument.ImportContext(ctx, basedir, pkg.ImportPath)
+	}
+	return instrument.ImportDirContext(ctx, basedir, dir)
+}
+
+// displayName returns the name the go tool reports pkg by.
+func displayName(pkg *instrument.Instrumentable) string {
+	if pkg.IsInGopath() {
+		return pkg.Package().ImportPath
+	} else if pkg.Package().Dir == "" {
+		return "command-line-arguments"
+	}
+	dir, err := filepath.Abs(pkg.Package().Dir)
+	if err != nil {
+		dir = pkg.Package().Dir
+	}
+	return "_" + filepath.ToSlash(dir)
+}
+
+// outputName returns the name of the binary built from pkg, without the .test suffix of tests.
+// As with the go tool, a package of files is named after its first file.
+func outputName(pkg *instrument.Instrumentable) string {
+	if p := pkg.Package(); p.Dir == "" && len(p.GoFiles) > 0 {
+		return strings.TrimSuffix(filepath.Base(p.GoFiles[0]), ".go")
+	}
+	if pkg.Package().Name != "main" {
+		return pkg.Package().Name
+	}
+	dir, err := filepath.Abs(pkg.Package().Dir)
+	if err != nil {
+		dir = pkg.Package().Dir
+	}
+	return filepath.Base(dir)
+}
+
+// fileParams returns the files of a package given by its files, as the go tool running in its
+// output directory is given them, and nil for other packages.
+func fileParams(pkg *instrument.Instrumentable) []string {
+	p := pkg.Package()
+	if p.Dir != "" {
+		return nil
+	}
+	var params []string
+	for _, files := range [][]string{p.GoFiles, p.TestGoFiles, p.XTestGoFiles} {
+		for _, file := range files {
+			// files are instrumented into the output directory of the package
+			params = append(params, filepath.Base(file))
+		}
+	}
+	return params
+}
+
+// buildPackages handles go build, go run and go test, given the packages pkgs. All packages are
+// instrumented into a single workspace. Build writes a binary for every main package, run builds
+// and runs the program, and test runs the tests of every package, and summarizes them as go test
+// does. With -ignored, the files of the packages excluded by build constraints are compiled first.
+func buildPackages(interrupts *Interrupts, gocmd *instrument.GoCmd, opts *options, pkgs []*instrument.Instrumentable) {
+	if len(pkgs) == 0 {
+		die(errors.New("no packages to " + gocmd.Command))
+	}
+	if len(pkgs) > 1 && gocmd.Command == "test" && gocmd.BuildFlags.Get("fuzz") != "" {
+		die(errors.New("cannot use -fuzz flag with multiple packages"))
+	}
+	for _, pkg := range pkgs {
+		configure(pkg, gocmd, opts)
+	}
+	if opts.ignored {
+		ok := true
+		for _, pkg := range pkgs {
+			ok = checkIgnored(interrupts, gocmd, pkg) && ok
+		}
+		if !ok {
+			panic(exitCode(1))
+		}
+	}
+	outdir, cleanup := workspace(interrupts, gocmd.BuildFlags.Bool("work"))
+	defer cleanup()
+	die(instrument.InstrumentAllTo(pkgs, gocmd.Command == "test", outdir, sloppyPatches))
+	bindir, binfile, err := binDir(gocmd, len(pkgs))
+	die(err)
+	// binary returns the file the binary of pkg is written to
+	binary := func(pkg *instrument.Instrumentable, suffix string) string {
+		if binfile != "" {
+			return binfile
+		}
+		return filepath.Join(bindir, outputName(pkg)+suffix)
+	}
+	sourcemap := pkgs[0].SourceMap()
+	if overlay := goOverlay(gocmd, sourcemap, outdir); overlay != "" {
+		withoverlay := *gocmd
+		withoverlay.BuildFlags = gocmd.BuildFlags.Clone()
+		withoverlay.BuildFlags.Set("overlay", overlay)
+		gocmd = &withoverlay
+	}
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	// as go test in local directory mode, the output of the tests is always shown
+	stream := len(gocmd.Params) == 0 || gocmd.HasFiles()
+	failed := false
+	var coverprofile string
+	var profiles []string
+	for n, pkg := range pkgs {
+		ok := true
+		switch gocmd.Command {
+		case "test":
+			profile := filepath.Join(outdir, fmt.Sprintf("cover%d.out", n))
+			output := ""
+			if gocmd.BuildFlags.Bool("c") || gocmd.BuildFlags.Get("o") != "" {
+				output = binary(pkg, ".test"+exe)
+			}
+			var requested string
+			ok, requested = testPackage(interrupts, gocmd, pkg, sourcemap, output, outdir, profile, stream)
+			if requested != "" {
+				coverprofile, profiles = requested, append(profiles, profile)
+			}
+		case "run":
+			runPackage(interrupts, gocmd, pkg, sourcemap, filepath.Join(outdir, filepath.Base(outdir)+exe))
+		default:
+			output := ""
+			if pkg.Package().Name == "main" {
+				output = binary(pkg, exe)
+			}
+			ok = buildPackage(interrupts, gocmd, pkg, sourcemap, output)
+		}
+		failed = failed || !ok
+	}
+	if coverprofile != "" {
+		if !filepath.IsAbs(coverprofile) {
+			coverprofile = filepath.Join(gocmd.WorkDir, coverprofile)
+		}
+		die(mergeCoverProfiles(sourcemap, profiles, coverprofile))
+	}
+	if failed {
+		if gocmd.Command == "test" && !stream && !gocmd.BuildFlags.Bool("json") {
+			fmt.Println("FAIL")
+		}
+		panic(exitCode(1))
+	}
+}
+
+// binDir returns the directory binaries are written to, which is -o if it names a directory,
+// and the working directory otherwise. If -o names a file, it is returned as file, which is
+// allowed for a single package only.
+func binDir(gocmd *instrument.GoCmd, npkgs int) (dir, file string, err error) {
+	o := gocmd.BuildFlags.Get("o")
+	if o == "" {
+		dir, err = filepath.Abs(gocmd.WorkDir)
+		return dir, "", err
+	}
+	if !filepath.IsAbs(o) {
+		o = filepath.Join(gocmd.WorkDir, o)
+	}
+	if info, err := os.Stat(o); err == nil && info.IsDir() || strings.HasSuffix(o, "/") {
+		dir, err = filepath.Abs(o)
+		return dir, "", err
+	}
+	if npkgs > 1 {
+		return "", "", errors.New("cannot write multiple packages to non-directory " + o)
+	}
+	file, err = filepath.Abs(o)
+	return filepath.Dir(file), file, err
+}
+
+// matchPackages expands the package patterns in params, warning about patterns matching no packages.
+func matchPackages(gocmd *instrument.GoCmd, params []string) []string {
+	pkgs, unmatched, err := instrument.MatchPackages(gocmd.Context(), gocmd.WorkDir, params)
+	die(err)
+	for _, pattern := range unmatched {
+		fmt.Fprintf(os.Stderr, "warning: %q matched no packages\n", pattern)
+	}
+	return pkgs
+}
+
+// goOverlay writes to outdir the overlay of the files gosloppy did not write, which the go tool
+// building the output of sourcemap reads from the overlay, and returns it, "" if there are none.
+func goOverlay(gocmd *instrument.GoCmd, sourcemap *instrument.SourceMap, outdir string) string {
+	overlay := sourcemap.GoOverlay(gocmd.Overlay)
+	if len(overlay) == 0 {
+		return ""
+	}
+	file, err := instrument.WriteOverlay(outdir, overlay)
+	die(err)
+	return file
+}
+
+// runRewritten runs cmd, rewriting references to instrumented files in its output to the
+// original sources. Relative paths in the output are relative to dir. With json, the standard
+// output of cmd is test2json events.
+func runRewritten(interrupts *Interrupts, sourcemap *instrument.SourceMap, cmd *exec.Cmd, dir string, json bool, stdout, stderr io.Writer) error {
+	rout, rerr := sourcemap.Rewriter(stdout, dir), sourcemap.Rewriter(stderr, dir)
+	if json {
+		rout = sourcemap.JSONRewriter(stdout, dir)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, rout, rerr
+	err := interrupts.Run(cmd)
+	rout.Flush()
+	rerr.Flush()
+	return err
+}
+
+func logCommand(gocmd, newgocmd *instrument.GoCmd) {
+	if gocmd.BuildFlags.Bool("x") {
+		log.Println("In:", newgocmd.WorkDir)
+		log.Println("Executing:", newgocmd)
+	}
+}
+
+// buildPackage builds pkg, writing the binary to output, unless it is empty.
+func buildPackage(interrupts *Interrupts, gocmd *instrument.GoCmd, pkg *instrument.Instrumentable, sourcemap *instrument.SourceMap, output string) bool {
+	newgocmd := &instrument.GoCmd{WorkDir: pkg.OutDir(), Executable: "go", Command: "build", BuildFlags: gocmd.BuildFlags.Clone(),
+		Params: fileParams(pkg), Env: append(append([]string{}, gocmd.Env...), pkg.GoEnv()...)}
+	for _, flag := range []string{"exec", "o"} {
+		newgocmd.BuildFlags.Delete(flag)
+	}
+	if output != "" {
+		newgocmd.BuildFlags.Set("o", output)
+	}
+	logCommand(gocmd, newgocmd)
+	err := runRewritten(interrupts, sourcemap, newgocmd.Runnable(), pkg.OutDir(), false, os.Stdout, os.Stderr)
+	if _, ok := exitStatus(err); !ok {
+		die(err)
+	}
+	return err == nil
+}
+
+// runPackage builds the program pkg to output, and runs it, with -exec if given, in the working
+// directory with the arguments following the files, as go run does. gosloppy exits with the exit
+// status of the program, which go run would report as 1.
+func runPackage(interrupts *Interrupts, gocmd *instrument.GoCmd, pkg *instrument.Instrumentable, sourcemap *instrument.SourceMap, output string) {
+	if !buildPackage(interrupts, gocmd, pkg, sourcemap, output) {
+		panic(exitCode(1))
+	}
+	r := command(strings.Fields(gocmd.BuildFlags.Get("exec")), output, gocmd.ExtraFlags...)
+	r.Dir = gocmd.WorkDir
+	exitOnError(runRewritten(interrupts, sourcemap, r, pkg.OutDir(), false, os.Stdout, os.Stderr))
+}
+
+// testPackage builds the test binary of pkg, and unless -c is given runs it in the original
+// package directory. The binary is written to output, or to outdir if output is empty. Its output
+// is shown for failing packages, with -v, or with stream, followed by a summary line.
+// coverprofile is the profile requested on the command line, if any, while the test binary writes
+// its profile to profile.
+func testPackage(interrupts *Interrupts, gocmd *instrument.GoCmd, pkg *instrument.Instrumentable, sourcemap *instrument.SourceMap, output, outdir, profile string, stream bool) (ok bool, coverprofile string) {
+	name := displayName(pkg)
+	if p := pkg.Package(); len(p.TestGoFiles)+len(p.XTestGoFiles) == 0 {
+		fmt.Printf("?   \t%s\t[no test files]\n", name)
+		return true, ""
+	}
+	newgocmd := &instrument.GoCmd{WorkDir: pkg.OutDir(), Executable: "go", Command: "test",
+		BuildFlags: gocmd.BuildFlags.Clone(), Params: fileParams(pkg), ExtraFlags: gocmd.ExtraFlags, Env: append(append([]string{}, gocmd.Env...), pkg.GoEnv()...)}
+	minusC := newgocmd.BuildFlags.Bool("c")
+	verbose := newgocmd.BuildFlags.Bool("v")
+	json := newgocmd.BuildFlags.Bool("json")
+	execprog := strings.Fields(newgocmd.BuildFlags.Get("exec"))
+	for _, flag := range []string{"exec", "json", "o"} {
+		newgocmd.BuildFlags.Delete(flag)
+	}
+	testargs := append(newgocmd.TestBinaryArgs(), fuzzArgs(newgocmd, pkg)...)
+	for i, arg := range testargs {
+		if strings.HasPrefix(arg, "-test.coverprofile=") {
+			coverprofile = strings.TrimPrefix(arg, "-test.coverprofile=")
+			testargs[i] = "-test.coverprofile=" + profile
+			newgocmd.BuildFlags.Set("cover", "true")
+		}
+	}
+	testbinary := output
+	if testbinary == "" {
+		testbinary = filepath.Join(outdir, filepath.Base(profile)+".test")
+	}
+	newgocmd.BuildFlags.Set("c", "true")
+	newgocmd.BuildFlags.Set("o", testbinary)
+	logCommand(gocmd, newgocmd)
+	err := runRewritten(interrupts, sourcemap, newgocmd.Runnable(), pkg.OutDir(), false, os.Stdout, os.Stderr)
+	if _, ok := exitStatus(err); !ok {
+		die(err)
+	}
+	if err != nil {
+		if json {
+			printBuildFailedEvents(name)
+		} else {
+			fmt.Printf("FAIL\t%s [build failed]\n", name)
+		}
+		return false, coverprofile
+	}
+	if minusC {
+		return true, coverprofile
+	}
+	var r *exec.Cmd
+	if json {
+		r = command([]string{"go", "tool", "test2json", "-t", "-p", name}, testbinary,
+			append([]string{"-test.v=test2json"}, testargs...)...)
+	} else {
+		r = command(execprog, testbinary, testargs...)
+	}
+	r.Dir = packageDir(pkg, gocmd.WorkDir)
+	out := new(bytes.Buffer)
+	var w io.Writer = out
+	if verbose || json || stream {
+		w = io.MultiWriter(os.Stdout, out)
+	}
+	start := time.Now()
+	err = runRewritten(interrupts, sourcemap, r, pkg.OutDir(), json, w, w)
+	elapsed := time.Since(start).Seconds()
+	if _, ok := exitStatus(err); !ok {
+		die(err)
+	}
+	if err != nil {
+		if w == out {
+			os.Stdout.Write(out.Bytes())
+		}
+		// test2json reported the failure already
+		if !json {
+			fmt.Printf("FAIL\t%s\t%.3fs\n", name, elapsed)
+		}
+		return false, coverprofile
+	}
+	if !json {
+		summary := fmt.Sprintf("ok  \t%s\t%.3fs", name, elapsed)
+		if coverage := coverageLine(out); coverage != "" {
+			summary += "\t" + coverage
+		}
+		fmt.Println(summary)
+	}
+	return true, coverprofile
+}
+
+// testEvent is an event go test -json prints, as cmd/test2json defines it.
+type testEvent struct {
+	Time        time.Time
+	Action      string
+	Package     string
+	Output      string `json:",omitempty"`
+	FailedBuild string `json:",omitempty"`
+}
+
+// printBuildFailedEvents prints the events go test -json reports a package whose test binary did
+// not build with.
+func printBuildFailedEvents(name string) {
+	now := time.Now()
+	for _, event := range []testEvent{
+		{now, "start", name, "", ""},
+		{now, "output", name, "FAIL\t" + name + " [build failed]\n", ""},
+		{now, "fail", name, "", name + " [" + name + ".test]"},
+	} {
+		data, err := json.Marshal(event)
+		die(err)
+		fmt.Println(string(data))
+	}
+}
+
+// coverageLine returns the "coverage: x% of statements" line of the test output, if any.
+func coverageLine(out *bytes.Buffer) string {
+	scanner := bufio.NewScanner(bytes.NewReader(out.Bytes()))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "coverage: ") {
+			return line
+		}
+	}
+	return ""
+}
+
+// mergeCoverProfiles writes the profiles written by the test binaries, rewritten to refer to the
+// original sources, into a single profile at orig.
+func mergeCoverProfiles(sourcemap *instrument.SourceMap, profiles []string, orig string) error {
+	merged := new(bytes.Buffer)
+	for _, profile := range profiles {
+		if _, err := os.Stat(profile); err != nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := rewriteCoverProfileTo(sourcemap, profile, buf); err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(buf)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "mode:") && merged.Len() > 0 {
+				continue
+			}
+			merged.WriteString(line + "\n")
+		}
+	}
+	return ioutil.WriteFile(orig, merged.Bytes(), 0644)
+}
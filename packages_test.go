@@ -0,0 +1,44 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/gosloppy/instrument"
+)
+
+func TestOutputName(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"cmd/prog.go": "package main;func main(){}",
+		"cmd/help.go": "package main",
+		"lib/lib.go":  "package library",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GO111MODULE", "off")
+	// as the go tool, a package of files is named after its first file, a command after its
+	// directory, and a library after its name
+	files := instrument.ImportFilesContext(&build.Default, "", filepath.Join(root, "cmd", "help.go"),
+		filepath.Join(root, "cmd", "prog.go"))
+	if name := outputName(files); name != "help" {
+		t.Error("Expected help got", name)
+	}
+	for dir, exp := range map[string]string{"cmd": "cmd", "lib": "library"} {
+		pkg, err := instrument.ImportDirContext(&build.Default, "", filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := outputName(pkg); name != exp {
+			t.Errorf("Expected %s got %s", exp, name)
+		}
+	}
+}
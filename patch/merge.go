@@ -0,0 +1,220 @@
+package patch
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// Overlap is the way the ranges two patches change in the original file overlap.
+type Overlap int
+
+const (
+	// NoOverlap patches change disjoint ranges. Insertions at the edge of a range, or at the same
+	// position, do not overlap, and are applied in the order they were given.
+	NoOverlap Overlap = iota
+	// Identical patches change the very same range.
+	Identical
+	// Nested patches change a range, one within the range the other changes.
+	Nested
+	// Partial patches change ranges that overlap, with neither containing the other.
+	Partial
+)
+
+func (o Overlap) String() string {
+	switch o {
+	case NoOverlap:
+		return "no overlap"
+	case Identical:
+		return "identical ranges changed differently"
+	case Nested:
+		return "a change nested in a changed range"
+	case Partial:
+		return "partially overlapping ranges"
+	}
+	return fmt.Sprintf("Overlap(%d)", int(o))
+}
+
+// OverlapOf classifies the way the ranges a and b change overlap.
+func OverlapOf(a, b Patch) Overlap {
+	as, ae, bs, be := a.StartPos(), a.EndPos(), b.StartPos(), b.EndPos()
+	switch {
+	case ae <= bs || be <= as:
+		return NoOverlap
+	case as == bs && ae == be:
+		return Identical
+	case as <= bs && be <= ae || bs <= as && ae <= be:
+		return Nested
+	}
+	return Partial
+}
+
+// Set is the patches a single visitor made, named after it for error messages.
+type Set struct {
+	Name    string
+	Patches Patches
+}
+
+// ConflictError reports two patches that cannot be applied together.
+type ConflictError struct {
+	Overlap Overlap
+	// Names are the names of the sets the patches came from, or #index in sets with no name
+	Names     [2]string
+	Positions [2]token.Position
+	Patches   [2]Patch
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s conflicts with %s at %s: %s",
+		e.Positions[0], describe(e.Names[0]), describe(e.Names[1]), e.Positions[1], e.Overlap)
+}
+
+func describe(name string) string {
+	if strings.HasPrefix(name, "#") {
+		return "patch " + name
+	}
+	return "patch of " + name
+}
+
+// Validate returns a *ConflictError if patches contradict each other, see Merge.
+func (p *PatchableFile) Validate(patches Patches) error {
+	_, err := p.Merge(Set{"", patches})
+	return err
+}
+
+// Merge returns the patches of all sets, in the order given, ready for FprintPatched.
+// Overlapping patches are merged when they are compatible:
+//   - identical patches, made for instance by two visitors rewriting the same import, are
+//     applied once
+//   - the same insertion at the same position by two sets, such as the "_ " two visitors add to
+//     an import, is applied once, while a set may insert the same text twice at a position
+//   - a removal within a range another patch changes is dropped, as the range is gone anyway
+//   - a patch within a node an InsertNodePatch inserts is kept, it applies to the inserted copy
+//
+// Any other overlap is a conflict, reported by a *ConflictError naming the sets involved, and
+// patches of sets with no name by their index.
+func (p *PatchableFile) Merge(sets ...Set) (Patches, error) {
+	type entry struct {
+		patch Patch
+		name  string
+		set   int
+	}
+	var entries []entry
+	var inserted []ast.Node
+	for s, set := range sets {
+		for n, patch := range set.Patches {
+			name := set.Name
+			if name == "" {
+				name = fmt.Sprint("#", n)
+			}
+			entries = append(entries, entry{patch, name, s})
+			if patch, ok := patch.(*InsertNodePatch); ok {
+				inserted = append(inserted, patch.Insert)
+			}
+		}
+	}
+	bystart := &StablePatches{make(Patches, len(entries)), make([]int, len(entries))}
+	for n, e := range entries {
+		bystart.patches[n], bystart.perm[n] = e.patch, n
+	}
+	sort.Sort(bystart)
+	dropped := make([]bool, len(entries))
+	// insertions at the same position do not overlap, and are compared on their own
+	for i, a := range bystart.perm {
+		for _, b := range bystart.perm[i+1:] {
+			if entries[b].patch.StartPos() != entries[a].patch.StartPos() {
+				break
+			}
+			x, y := a, b
+			if y < x {
+				x, y = y, x
+			}
+			if entries[x].set != entries[y].set && isInsert(entries[x].patch) && isInsert(entries[y].patch) &&
+				samePatch(entries[x].patch, entries[y].patch) {
+				dropped[y] = true
+			}
+		}
+	}
+	for i, a := range bystart.perm {
+		for _, b := range bystart.perm[i+1:] {
+			if entries[b].patch.StartPos() >= entries[a].patch.EndPos() {
+				break
+			}
+			// x is the patch given first
+			x, y := a, b
+			if y < x {
+				x, y = y, x
+			}
+			if dropped[x] || dropped[y] {
+				continue
+			}
+			first, second := entries[x], entries[y]
+			in := y
+			if contains(second.patch, first.patch) {
+				in = x
+			}
+			switch overlap := OverlapOf(first.patch, second.patch); {
+			case overlap == NoOverlap:
+			case overlap == Identical && samePatch(first.patch, second.patch):
+				dropped[y] = true
+			case overlap == Nested && within(entries[in].patch, inserted):
+			case overlap == Nested && isRemove(entries[in].patch):
+				dropped[in] = true
+			default:
+				return nil, &ConflictError{overlap, [2]string{first.name, second.name},
+					[2]token.Position{p.Fset.Position(first.patch.StartPos()), p.Fset.Position(second.patch.StartPos())},
+					[2]Patch{first.patch, second.patch}}
+			}
+		}
+	}
+	merged := Patches{}
+	for n, e := range entries {
+		if !dropped[n] {
+			merged = append(merged, e.patch)
+		}
+	}
+	return merged, nil
+}
+
+// samePatch reports whether the patches of the same range make the same change.
+func samePatch(a, b Patch) bool {
+	switch a := a.(type) {
+	case *InsertPatch:
+		b, ok := b.(*InsertPatch)
+		return ok && a.Insert == b.Insert
+	case *InsertNodePatch:
+		b, ok := b.(*InsertNodePatch)
+		return ok && a.Insert == b.Insert
+	case RemovePatch:
+		_, ok := b.(RemovePatch)
+		return ok
+	}
+	return false
+}
+
+// contains reports whether the range p changes is within the range outer changes.
+func contains(outer, p Patch) bool {
+	return outer.StartPos() <= p.StartPos() && p.EndPos() <= outer.EndPos()
+}
+
+// isInsert reports whether p inserts text, or a node, without changing the original.
+func isInsert(p Patch) bool {
+	return p.StartPos() == p.EndPos()
+}
+
+func isRemove(p Patch) bool {
+	_, ok := p.(RemovePatch)
+	return ok && p.StartPos() < p.EndPos()
+}
+
+// within reports whether the range p changes is in one of nodes.
+func within(p Patch, nodes []ast.Node) bool {
+	for _, nd := range nodes {
+		if contains(RemovePatch{nd}, p) {
+			return true
+		}
+	}
+	return false
+}
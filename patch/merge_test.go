@@ -0,0 +1,84 @@
+package patch
+
+import (
+	"go/ast"
+	"testing"
+)
+
+func TestOverlapOf(t *testing.T) {
+	patchable := parse("package main;func f() { a := b + c }", t)
+	assign := patchable.File.Decls[0].(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+	sum := assign.Rhs[0].(*ast.BinaryExpr)
+	for _, c := range []struct {
+		a, b Patch
+		exp  Overlap
+	}{
+		{Replace(sum.X, "d"), Replace(sum.Y, "e"), NoOverlap},
+		{Insert(sum.Pos(), "("), Replace(sum, "d"), NoOverlap},
+		{Insert(sum.End(), ")"), Replace(sum, "d"), NoOverlap},
+		{Insert(sum.Pos(), "("), Insert(sum.Pos(), "(("), NoOverlap},
+		{Replace(sum, "d"), Remove(sum), Identical},
+		{Replace(sum, "d"), Replace(sum.X, "e"), Nested},
+		{Insert(sum.OpPos, "-"), Replace(sum, "d"), Nested},
+		{Replace(sum, "d"), Replace(assign.Lhs[0], "e"), NoOverlap},
+		{Replace(sum, "d"), &InsertPatch{BasePatch{assign.TokPos, sum.OpPos}, "e"}, Partial},
+	} {
+		if o := OverlapOf(c.a, c.b); o != c.exp {
+			t.Errorf("%s and %s: expected %s got %s", patchable.Slice(c.a.StartPos(), c.a.EndPos()),
+				patchable.Slice(c.b.StartPos(), c.b.EndPos()), c.exp, o)
+		}
+		if o := OverlapOf(c.b, c.a); o != c.exp {
+			t.Errorf("OverlapOf is not symmetric, expected %s got %s", c.exp, o)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	patchable := parse("package main;import \"a/b\";func f() { x = must(g(y)) }", t)
+	imp := patchable.File.Imports[0]
+	assign := patchable.File.Decls[1].(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+	must := assign.Rhs[0].(*ast.CallExpr)
+	arg := must.Args[0].(*ast.CallExpr)
+	merged, err := patchable.Merge(
+		Set{"unused", Patches{Insert(imp.Pos(), "_ "), Replace(imp.Path, `"./b"`)}},
+		Set{"rewrite", Patches{Replace(imp.Path, `"./b"`)}},
+	)
+	OrFail(err, t)
+	expect(t, patchable.File, patchable, "package main;import _ \"./b\";func f() { x = must(g(y)) }", merged...)
+	// two sets marking the same import used get a single "_ ", one set inserting twice keeps both
+	merged, err = patchable.Merge(
+		Set{"unused", Patches{Insert(imp.Pos(), "_ ")}},
+		Set{"shorterror", Patches{Insert(imp.Pos(), "_ "), Insert(arg.Pos(), "("), Insert(arg.Pos(), "(")}},
+		Set{"must", Patches{Insert(arg.End(), "))")}},
+	)
+	OrFail(err, t)
+	expect(t, patchable.File, patchable, "package main;import _ \"a/b\";func f() { x = must(((g(y)))) }", merged...)
+	merged, err = patchable.Merge(
+		Set{"must", Patches{InsertNode(assign.Pos(), arg), Insert(assign.Pos(), ";"), Replace(must, "t")}},
+		Set{"unused", Patches{Replace(arg.Args[0], "z"), Remove(arg.Fun)}},
+	)
+	OrFail(err, t)
+	if len(merged) != 5 {
+		t.Error("patches in the inserted node should be kept, got", merged)
+	}
+	expect(t, patchable.File, patchable, "package main;import \"a/b\";func f() { (z);x = t }", merged...)
+	merged, err = patchable.Merge(Set{"", Patches{Replace(arg, "h()"), Remove(arg.Args[0])}})
+	OrFail(err, t)
+	if len(merged) != 1 {
+		t.Error("removal within a replaced range should be dropped, got", merged)
+	}
+	_, err = patchable.Merge(Set{"unused", Patches{Replace(must, "h()")}}, Set{"must", Patches{Insert(arg.Lparen, "(")}})
+	expectErr(t, "1:42: patch of unused conflicts with patch of must at 1:48: a change nested in a changed range", err)
+	err = patchable.Validate(Patches{Replace(imp.Path, `"./b"`), Replace(imp.Path, `"../b"`)})
+	expectErr(t, "1:21: patch #0 conflicts with patch #1 at 1:21: identical ranges changed differently", err)
+	err = patchable.Validate(Patches{Replace(arg, "h()"), &InsertPatch{BasePatch{must.Lparen, arg.Lparen}, "("}})
+	if err, ok := err.(*ConflictError); !ok || err.Overlap != Partial {
+		t.Error("Expected a partial overlap, got", err)
+	}
+}
+
+func expectErr(t *testing.T, exp string, err error) {
+	if err == nil || err.Error() != exp {
+		t.Errorf("Expected error %q got %v", exp, err)
+	}
+}
@@ -0,0 +1,62 @@
+package patch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Overlay maps file names to contents that take precedence over the files on disk, such as the
+// unsaved buffers of an editor. A nil content means the file was deleted. Names are absolute clean
+// paths, as NewOverlay makes them.
+type Overlay map[string][]byte
+
+// NewOverlay returns the overlay of files, whose names may be relative to the working directory.
+func NewOverlay(files map[string][]byte) Overlay {
+	o := Overlay{}
+	for name, src := range files {
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+		o[filepath.Clean(name)] = src
+	}
+	return o
+}
+
+// Get returns the content the overlay has for the file name, and whether it has it. Relative names
+// are relative to the working directory.
+func (o Overlay) Get(name string) (src []byte, ok bool) {
+	if len(o) == 0 {
+		return nil, false
+	}
+	if src, ok := o[name]; ok {
+		return src, true
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, false
+	}
+	src, ok = o[abs]
+	return src, ok
+}
+
+// ReadFile reads the file name from the overlay, or from disk if the overlay does not have it.
+func (o Overlay) ReadFile(name string) ([]byte, error) {
+	src, ok := o.Get(name)
+	switch {
+	case !ok:
+		return ioutil.ReadFile(name)
+	case src == nil:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return src, nil
+}
+
+// ParsePatchableOverlay is like ParsePatchable, but reads the file from the overlay if it has it.
+func ParsePatchableOverlay(name string, overlay Overlay) (*PatchableFile, error) {
+	buf, err := overlay.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePatchableSource(name, buf)
+}
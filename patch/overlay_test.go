@@ -0,0 +1,33 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	defer cleanUp()
+	name, deleted := file(`package main;func f()`), file(`package main`)
+	overlay := Overlay{name: []byte(`package main;func g()`), deleted: nil}
+	pkg := NewPatchablePkg()
+	pkg.Overlay = overlay
+	OrFail(pkg.ParseFile(name), t)
+	ensureScope(t, pkg.Scope, "g")
+	if _, err := overlay.ReadFile(deleted); !os.IsNotExist(err) {
+		t.Error("Expected a deleted file not to exist, got", err)
+	}
+	// names are looked up as absolute clean paths
+	wd, err := os.Getwd()
+	OrFail(err, t)
+	rel, err := filepath.Rel(wd, deleted)
+	OrFail(err, t)
+	if _, ok := NewOverlay(map[string][]byte{"./" + rel: nil}).Get(deleted); !ok {
+		t.Error("Expected", deleted, "in the overlay")
+	}
+	patchable, err := ParsePatchableOverlay(deleted, Overlay{"other.go": nil})
+	OrFail(err, t)
+	if patchable.Orig != "package main" {
+		t.Error("Expected the file on disk, got", patchable.Orig)
+	}
+}
@@ -1,11 +1,12 @@
 package patch
 
 import (
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
 	"io"
-	"io/ioutil"
+	"path/filepath"
 	"sort"
 )
 
@@ -15,6 +16,10 @@ type PatchableFile struct {
 	File     *ast.File
 	Fset     *token.FileSet
 	Orig     string
+	// LineDirectives makes FprintPatched emit a /*line file:line:col*/ directive wherever original
+	// text follows inserted text, so that positions reported by the compiler and the runtime
+	// are those of the original file.
+	LineDirectives bool
 }
 
 type Patch interface {
@@ -82,16 +87,17 @@ func Remove(nd ast.Node) Patch {
 }
 
 func ParsePatchable(name string) (*PatchableFile, error) {
+	return ParsePatchableOverlay(name, nil)
+}
+
+// ParsePatchableSource parses the file name with the content buf, which need not be on disk.
+func ParsePatchableSource(name string, buf []byte) (*PatchableFile, error) {
 	fset := token.NewFileSet()
-	buf, err := ioutil.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
 	file, err := parser.ParseFile(fset, name, buf, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
-	return &PatchableFile{file.Name.Name, name, file, fset, string(buf)}, nil
+	return &PatchableFile{file.Name.Name, name, file, fset, string(buf), false}, nil
 }
 
 func (p *PatchableFile) Get(node ast.Node) string {
@@ -126,66 +132,153 @@ func (p *StablePatches) Less(i, j int) bool {
 		p.patches[j].StartPos() == p.patches[i].StartPos() && p.perm[i] < p.perm[j]
 }
 
-func sorted(patches []Patch) Patches {
-
+func sorted(patches []Patch) sortedPatches {
 	sorted := &StablePatches{make(Patches, len(patches)), make([]int, len(patches))}
 	for i := 0; i < len(sorted.perm); i++ {
 		sorted.perm[i] = i
 	}
 	copy(sorted.patches, patches)
 	sort.Sort(sorted)
-	return sorted.patches
+	return sortedPatches(sorted.patches)
+}
+
+// printer writes the patched output, and records where each part of it came from
+type printer struct {
+	w          io.Writer
+	total      int
+	err        error
+	m          *PosMap
+	directives bool
+	// next is the original offset which would follow the output so far, if it was not patched
+	next int
+	// filename is used in line directives, empty filename keeps the current one
+	filename string
+	// depth is the number of InsertNodePatch nodes being printed
+	depth int
 }
 
-func write(oldn *int, err *error, w io.Writer, s string) {
+func (pr *printer) write(s string) {
 	var n int
-	n, *err = io.WriteString(w, s)
-	*oldn += n
-	if *err != nil {
-		panic(*err)
+	n, pr.err = io.WriteString(pr.w, s)
+	pr.total += n
+	if pr.err != nil {
+		panic(pr.err)
 	}
 }
 
+// copyOrig copies orig[from:to] to the output
+func (pr *printer) copyOrig(orig string, from, to int) {
+	if from == to {
+		return
+	}
+	if pr.directives && from != pr.next {
+		pos := position(pr.filename, pr.m.origLines, from)
+		pr.insert(from, fmt.Sprintf("/*line %s:%d:%d*/", pos.Filename, pos.Line, pos.Column))
+	}
+	pr.m.add(pr.total, from, to-from, false, pr.depth > 0, orig[from:to])
+	pr.write(orig[from:to])
+	pr.next = to
+}
+
+// insert writes text that does not appear in the original file at offset at
+func (pr *printer) insert(at int, s string) {
+	if s == "" {
+		return
+	}
+	pr.m.add(pr.total, at, len(s), true, pr.depth > 0, s)
+	pr.write(s)
+	// text after an insertion must be preceded by a line directive
+	pr.next = -1
+}
+
 // Write the file with patches applied in that order.
-// Note: If patches contradicts each other, behaviour is undefined.
+// Note: If patches contradicts each other, behaviour is undefined. Use Validate, or Merge, to
+// check them first.
 func (p *PatchableFile) FprintPatched(w io.Writer, nd ast.Node, patches []Patch) (total int, err error) {
+	_, total, err = p.FprintPatchedMap(w, nd, patches)
+	return
+}
+
+// FprintPatchedMap is like FprintPatched, but also returns a PosMap that maps positions between
+// the patched output and the original file.
+func (p *PatchableFile) FprintPatchedMap(w io.Writer, nd ast.Node, patches []Patch) (m *PosMap, total int, err error) {
+	pr := &printer{w: w, m: newPosMap(p.FileName, p.Orig), directives: p.LineDirectives, next: -1, filename: p.FileName}
+	// relative file names in line directives are relative to the patched file
+	if abs, err := filepath.Abs(p.FileName); err == nil && p.FileName != "" {
+		pr.filename = abs
+	}
 	defer func() {
-		if r := recover(); r != nil && err == nil {
+		if r := recover(); r != nil && pr.err == nil {
 			panic(r)
 		}
+		m, total, err = pr.m, pr.total, pr.err
 	}()
-	sorted := sorted(patches)
+	p.fprintPatched(pr, nd, sorted(patches), nil)
+	return
+}
+
+// sortedPatches are patches sorted by their start, patches starting at the same position in the
+// order given, so that the patches starting within a node are found by binary search.
+type sortedPatches Patches
+
+// within returns the patches starting between from and to, inclusive.
+func (s sortedPatches) within(from, to token.Pos) sortedPatches {
+	lo := sort.Search(len(s), func(i int) bool { return s[i].StartPos() >= from })
+	hi := sort.Search(len(s), func(i int) bool { return s[i].StartPos() > to })
+	return s[lo:hi]
+}
+
+// fprintPatched prints nd with the patches starting within it. The nodes InsertNodePatch inserts
+// are printed the same way, in a single pass over the patches, except that patches replacing or
+// removing a node being inserted, given in inserted, are not applied to its copy.
+func (p *PatchableFile) fprintPatched(pr *printer, nd ast.Node, patches sortedPatches, inserted []ast.Node) {
 	start, end := p.Fset.Position(nd.Pos()), p.Fset.Position(nd.End())
+	from, to := nd.Pos(), nd.End()
 	// for some reason, the start of an *ast.File is not the initial comment
-	if _, ok := nd.(*ast.File); ok {
+	if file, ok := nd.(*ast.File); ok {
 		start = p.Fset.Position(0)
 		end = p.Fset.Position(token.Pos(len(p.Orig) + 1))
+		// so that comments before the package clause can be patched as well
+		if f := p.Fset.File(file.Package); f != nil {
+			from, to = token.Pos(f.Base()), token.Pos(f.Base()+f.Size())
+		}
 	}
 	prev := start.Offset
-	for _, patch := range sorted {
-		if nd.Pos() <= patch.StartPos() && nd.End() >= patch.StartPos() {
-			pos := p.Fset.Position(patch.StartPos())
-			write(&total, &err, w, p.Orig[prev:pos.Offset])
-			switch patch := patch.(type) {
-			case *InsertPatch:
-				write(&total, &err, w, patch.Insert)
-			case *InsertNodePatch:
-				// TODO(elazar): check performance implications
-				noremove := Patches{}
-				for _, p := range patches {
-					// If the patch removes a certain node
-					if p.StartPos() == patch.Insert.Pos() && p.EndPos() == patch.Insert.End() {
-						continue
-					}
-					noremove = append(noremove, p)
-				}
-				p.FprintPatched(w, patch.Insert, noremove)
-			}
-			prev = p.Fset.Position(patch.EndPos()).Offset
+	if pr.total == 0 {
+		// nothing was inserted before the first original byte
+		pr.next = prev
+	}
+	for _, patch := range patches.within(from, to) {
+		if changesNode(patch, inserted) {
+			continue
+		}
+		pos := p.Fset.Position(patch.StartPos())
+		if pos.Offset < prev {
+			// within a range an earlier patch changed, and applied to an inserted copy if any
+			continue
 		}
+		pr.copyOrig(p.Orig, prev, pos.Offset)
+		switch patch := patch.(type) {
+		case *InsertPatch:
+			pr.insert(pos.Offset, patch.Insert)
+		case *InsertNodePatch:
+			pr.depth++
+			p.fprintPatched(pr, patch.Insert, patches, append(inserted, patch.Insert))
+			pr.depth--
+		}
+		prev = p.Fset.Position(patch.EndPos()).Offset
 	}
 	if prev < end.Offset {
-		write(&total, &err, w, p.Orig[prev:end.Offset])
+		pr.copyOrig(p.Orig, prev, end.Offset)
 	}
-	return
+}
+
+// changesNode reports whether the patch replaces or removes one of nodes.
+func changesNode(patch Patch, nodes []ast.Node) bool {
+	for _, nd := range nodes {
+		if patch.StartPos() == nd.Pos() && patch.EndPos() == nd.End() {
+			return true
+		}
+	}
+	return false
 }
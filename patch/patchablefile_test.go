@@ -2,20 +2,22 @@ package patch
 
 import (
 	"bytes"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"runtime"
 	"testing"
 )
 
-func parse(code string, t *testing.T) *PatchableFile {
+func parse(code string, t testing.TB) *PatchableFile {
 	fset := token.NewFileSet()
 	file, err := parser.ParseFile(fset, "", code, parser.DeclarationErrors|parser.ParseComments)
 	if err != nil {
 		t.Fatal("Cannot parse code", err)
 	}
-	return &PatchableFile{file.Name.Name, "", file, fset, code}
+	return &PatchableFile{file.Name.Name, "", file, fset, code, false}
 }
 
 func TestPatchableFileNoPatches(t *testing.T) {
@@ -44,13 +46,14 @@ f   ( ) {
 }
 
 func TestHeaderComment(t *testing.T) {
-	buf := new(bytes.Buffer)
 	body := "//hoho\npackage main"
 	patchable := parse(body, t)
-	patchable.FprintPatched(buf, patchable.File, nil)
-	if buf.String() != body {
-		t.Error("Expected:\n", body, "\nGot:\n", buf.String())
-	}
+	expect(t, patchable.File, patchable, body)
+}
+
+func TestPatchHeaderComment(t *testing.T) {
+	patchable := parse("//go:build ignore\n\npackage main", t)
+	expect(t, patchable.File, patchable, "//\n\npackage main", Replace(patchable.File.Comments[0].List[0], "//"))
 }
 
 var body = `package main
@@ -60,60 +63,45 @@ f   ( ) {
         }`
 
 func TestPatchableFileSimple(t *testing.T) {
-	buf := new(bytes.Buffer)
 	patchable := parse(body, t)
-	patchable.FprintPatched(buf, patchable.File, Patches{Insert(patchable.File.Decls[0].Pos(), "/* before */")})
-	exp :=
+	expect(t, patchable.File, patchable,
 		`package main
 /* before */func
 
 f   ( ) {
-        }`
-	if buf.String() != exp {
-		t.Errorf("Expected ===:\n%s\nActual ===:\n%s\n PatchableFile differ from expected", exp, buf.String())
-	}
-	buf.Reset()
-	patchable.FprintPatched(buf, patchable.File, Patches{Insert(patchable.File.Decls[0].Pos(), "/* before */"),
-		Insert(patchable.File.Decls[0].(*ast.FuncDecl).Name.Pos(), "/* f */"),
-		Replace(patchable.File.Decls[0].(*ast.FuncDecl).Name, "g"),
-		Insert(patchable.File.Package, "/* package */")})
-	exp =
+        }`,
+		Insert(patchable.File.Decls[0].Pos(), "/* before */"))
+	expect(t, patchable.File, patchable,
 		`/* package */package main
 /* before */func
 
 /* f */g   ( ) {
-        }`
-	if buf.String() != exp {
-		t.Errorf("Expected ===:\n%s\nActual ===:\n%s\n PatchableFile differ from expected", exp, buf.String())
-	}
-	buf.Reset()
-	patchable.FprintPatched(buf, patchable.File.Decls[0], Patches{Insert(patchable.File.Decls[0].Pos(), "/* before */")})
-	exp =
+        }`,
+		Insert(patchable.File.Decls[0].Pos(), "/* before */"),
+		Insert(patchable.File.Decls[0].(*ast.FuncDecl).Name.Pos(), "/* f */"),
+		Replace(patchable.File.Decls[0].(*ast.FuncDecl).Name, "g"),
+		Insert(patchable.File.Package, "/* package */"))
+	expect(t, patchable.File.Decls[0], patchable,
 		`/* before */func
 
 f   ( ) {
-        }`
-	if buf.String() != exp {
-		t.Errorf("%s\n===\n%s\nfunction differ from orig", exp, buf.String())
-	}
-	buf.Reset()
-	patchable.FprintPatched(buf, patchable.File.Decls[0], Patches{
-		Insert(patchable.File.Decls[0].Pos(), "/* before */"),
-		Insert(patchable.File.Decls[0].(*ast.FuncDecl).Name.Pos(), "/* f */"),
-		Insert(patchable.File.Package, "/* import */")})
-	exp =
+        }`,
+		Insert(patchable.File.Decls[0].Pos(), "/* before */"))
+	expect(t, patchable.File.Decls[0], patchable,
 		`/* before */func
 
 /* f */f   ( ) {
-        }`
-	if buf.String() != exp {
-		t.Errorf("%s\n===\n%s\nfunction differ from orig", exp, buf.String())
-	}
+        }`,
+		Insert(patchable.File.Decls[0].Pos(), "/* before */"),
+		Insert(patchable.File.Decls[0].(*ast.FuncDecl).Name.Pos(), "/* f */"),
+		Insert(patchable.File.Package, "/* import */"))
 }
 
 func expect(t *testing.T, node ast.Node, patchable *PatchableFile, exp string, patches ...Patch) {
 	buf := new(bytes.Buffer)
-	patchable.FprintPatched(buf, node, patches)
+	m, _, err := patchable.FprintPatchedMap(buf, node, patches)
+	OrFail(err, t)
+	checkPosMap(t, patchable, buf.String(), m)
 	if buf.String() != exp {
 		_, filename, line, ok := runtime.Caller(1)
 		if !ok {
@@ -138,3 +126,70 @@ func TestInsertNode(t *testing.T) {
 		InsertNode(patchable.File.Name.Pos(), patchable.File.Decls[0]),
 	)
 }
+
+func TestLineDirectives(t *testing.T) {
+	patchable := parse("package main\nfunc f() {\n\ta := 1\n}", t)
+	patchable.LineDirectives = true
+	body := patchable.File.Decls[0].(*ast.FuncDecl).Body
+	expect(t, patchable.File, patchable,
+		"package main\nfunc f() {_ = a;/*line :2:11*/\n\ta := 1\n}",
+		Insert(body.Lbrace+1, "_ = a;"))
+	expect(t, patchable.File, patchable,
+		"package main\nfunc f() {\n\tb/*line :3:3*/ := 1\n}",
+		Replace(body.List[0].(*ast.AssignStmt).Lhs[0], "b"))
+	expect(t, patchable.File, patchable,
+		"package main\nfunc f() {\n\ta := 1\n}; var _ = 1",
+		Insert(patchable.File.End(), "; var _ = 1"))
+
+	patchable = parse("package kola;func fola()", t)
+	patchable.LineDirectives = true
+	expect(t, patchable.File, patchable,
+		"package /*line :1:14*/func fola()/*line :1:9*/kola;",
+		Remove(patchable.File.Decls[0]),
+		InsertNode(patchable.File.Name.Pos(), patchable.File.Decls[0]),
+	)
+}
+
+// mustFile returns a file of n functions, with the patches rewriting the must call of each, as
+// ShortError does, and an argument within the copy of the node it moves.
+func mustFile(n int, tb testing.TB) (patchable *PatchableFile, patches Patches, exp string) {
+	src, out := new(bytes.Buffer), new(bytes.Buffer)
+	src.WriteString("package main\n")
+	out.WriteString("package main\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(src, "func f%d() {\n\tx = must(g(y))\n}\n", i)
+		fmt.Fprintf(out, "func f%d() {\n\tg(z);x = t\n}\n", i)
+	}
+	patchable = parse(src.String(), tb)
+	for _, decl := range patchable.File.Decls {
+		assign := decl.(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+		must := assign.Rhs[0].(*ast.CallExpr)
+		arg := must.Args[0].(*ast.CallExpr)
+		patches = append(patches, InsertNode(assign.Pos(), arg), Insert(assign.Pos(), ";"),
+			Replace(must, "t"), Replace(arg.Args[0], "z"))
+	}
+	return patchable, patches, out.String()
+}
+
+func TestFprintPatchedMany(t *testing.T) {
+	patchable, patches, exp := mustFile(100, t)
+	expect(t, patchable.File, patchable, exp, patches...)
+}
+
+func BenchmarkFprintPatched(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		patchable, patches, exp := mustFile(n, b)
+		buf := new(bytes.Buffer)
+		if _, err := patchable.FprintPatched(buf, patchable.File, patches); err != nil || buf.String() != exp {
+			b.Fatalf("%d functions: unexpected output, error %v", n, err)
+		}
+		b.Run(fmt.Sprint(n, "funcs"), func(b *testing.B) {
+			b.SetBytes(int64(len(patchable.Orig)))
+			for i := 0; i < b.N; i++ {
+				if _, err := patchable.FprintPatched(ioutil.Discard, patchable.File, patches); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
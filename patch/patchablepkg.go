@@ -1,41 +1,23 @@
 package patch
 
 import (
+	"fmt"
 	"go/ast"
-	"go/build"
+	"path/filepath"
 )
 
 type PatchablePkg struct {
 	Name  string
 	Scope *ast.Scope
 	Files map[string]*PatchableFile
+	// Overlay has the files ParseFile reads rather than reading them from disk
+	Overlay Overlay
+	// XTest is the external test package of the package, if it has one
+	XTest *PatchablePkg
 	// Imports not used, since I don't want to parse all imports
 	// Imports map[string]PatchablePkg
 }
 
-// TODO(elazar): this is very basic, and requires more work for edge cases and builds with C
-// Warning, file ASTs are SHARED between test and pkg. This might be desired, need to think over.
-func ParsePackage(buildpkg *build.Package) (pkg *PatchablePkg, testpkg *PatchablePkg, err error) {
-	pkg = NewPatchablePkg()
-	testpkg = NewPatchablePkg()
-	if err := pkg.ParseFiles(buildpkg.GoFiles...); err != nil {
-		return nil, nil, err
-	}
-	if err := pkg.ParseFiles(buildpkg.CgoFiles...); err != nil {
-		return nil, nil, err
-	}
-	for k, v := range pkg.Files {
-		testpkg.Files[k] = v
-	}
-	for _, obj := range pkg.Scope.Objects {
-		testpkg.Scope.Insert(obj)
-	}
-	if err := testpkg.ParseFiles(buildpkg.TestGoFiles...); err != nil {
-		return nil, nil, err
-	}
-	return pkg, testpkg, nil
-}
-
 func ParseFiles(files ...string) (*PatchablePkg, error) {
 	pkg := NewPatchablePkg()
 	if err := pkg.ParseFiles(files...); err != nil {
@@ -61,10 +43,18 @@ func (pkg *PatchablePkg) ParseFiles(files ...string) error {
 }
 
 func (pkg *PatchablePkg) ParseFile(file string) error {
-	patchable, err := ParsePatchable(file)
+	patchable, err := ParsePatchableOverlay(file, pkg.Overlay)
 	if err != nil {
 		return err
 	}
+	pkg.AddFile(file, patchable)
+	return nil
+}
+
+// AddFile adds an already parsed file to the package, and inserts its top level objects to the
+// package scope. Files can thus be parsed concurrently, and then added one by one in a
+// deterministic order.
+func (pkg *PatchablePkg) AddFile(file string, patchable *PatchableFile) {
 	if pkg.Name != "" && pkg.Name != patchable.PkgName {
 		panic("ParsePkg called with files in two different packages. Had " +
 			pkg.Name + " got " + patchable.PkgName + " from " + file)
@@ -78,5 +68,80 @@ func (pkg *PatchablePkg) ParseFile(file string) error {
 		pkg.Scope.Insert(obj)
 	}
 	patchable.File.Scope.Outer = pkg.Scope
+}
+
+// FileOp is the change a FilePatch makes to a package.
+type FileOp int
+
+const (
+	// AddOp adds a file the package does not have
+	AddOp FileOp = iota
+	// ReplaceOp replaces the content of a file of the package
+	ReplaceOp
+	// RemoveOp removes a file from the package
+	RemoveOp
+)
+
+func (op FileOp) String() string {
+	switch op {
+	case AddOp:
+		return "add"
+	case ReplaceOp:
+		return "replace"
+	case RemoveOp:
+		return "remove"
+	}
+	return fmt.Sprintf("FileOp(%d)", int(op))
+}
+
+// FilePatch adds, replaces or removes a whole file of a package, where a Patch changes a part of
+// a file. Name is the base name of the file in the package directory.
+type FilePatch struct {
+	Op      FileOp
+	Name    string
+	Content string
+}
+
+type FilePatches []*FilePatch
+
+// AddFile adds a file with content to the package, such as a generated stub.
+func AddFile(name, content string) *FilePatch {
+	return &FilePatch{AddOp, name, content}
+}
+
+// ReplaceFile replaces the file of the package with content.
+func ReplaceFile(name, content string) *FilePatch {
+	return &FilePatch{ReplaceOp, name, content}
+}
+
+// RemoveFile removes the file from the package.
+func RemoveFile(name string) *FilePatch {
+	return &FilePatch{RemoveOp, name, ""}
+}
+
+// ValidateFiles returns an error if a patch adds a file the package has, replaces or removes a
+// file it does not have, or if two patches change the same file. The files of XTest are files of
+// the package too.
+func (pkg *PatchablePkg) ValidateFiles(patches FilePatches) error {
+	has := map[string]bool{}
+	for p := pkg; p != nil; p = p.XTest {
+		for file := range p.Files {
+			has[filepath.Base(file)] = true
+		}
+	}
+	changed := map[string]bool{}
+	for _, p := range patches {
+		switch {
+		case p.Name == "" || filepath.Base(p.Name) != p.Name:
+			return fmt.Errorf("cannot %s %q, not a file name", p.Op, p.Name)
+		case changed[p.Name]:
+			return fmt.Errorf("cannot %s %s, it was already changed", p.Op, p.Name)
+		case p.Op == AddOp && has[p.Name]:
+			return fmt.Errorf("cannot add %s, package %s already has it", p.Name, pkg.Name)
+		case p.Op != AddOp && !has[p.Name]:
+			return fmt.Errorf("cannot %s %s, package %s does not have it", p.Op, p.Name, pkg.Name)
+		}
+		changed[p.Name] = true
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"go/ast"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 )
@@ -55,3 +56,85 @@ func ensureScope(t *testing.T, scope *ast.Scope, expected ...string) []string {
 	}
 	return names
 }
+
+func TestValidateFiles(t *testing.T) {
+	defer cleanUp()
+	pkg := NewPatchablePkg()
+	name := file(`package main;func f()`)
+	pkg.ParseFile(name)
+	base := filepath.Base(name)
+	if err := pkg.ValidateFiles(FilePatches{AddFile("stub.go", "package main"), ReplaceFile(base, "package main")}); err != nil {
+		t.Error("Expected valid file patches got", err)
+	}
+	for _, c := range []struct {
+		patches FilePatches
+		exp     string
+	}{
+		{FilePatches{AddFile(base, "package main")}, "cannot add " + base + ", package main already has it"},
+		{FilePatches{RemoveFile("stub.go")}, "cannot remove stub.go, package main does not have it"},
+		{FilePatches{RemoveFile(base), ReplaceFile(base, "")}, "cannot replace " + base + ", it was already changed"},
+		{FilePatches{AddFile("a/stub.go", "")}, `cannot add "a/stub.go", not a file name`},
+	} {
+		if err := pkg.ValidateFiles(c.patches); err == nil || err.Error() != c.exp {
+			t.Errorf("Expected error %q got %v", c.exp, err)
+		}
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosloppy.patch.test")
+	OrFail(err, t)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"a.go":      "package a;func helper() {};func F() {}",
+		"a_test.go": "package a;func TestHelper() { helper() }",
+	} {
+		OrFail(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), t)
+	}
+	// the library, and the library with its tests, are parsed on their own, as the go tool builds them
+	a, atest := filepath.Join(dir, "a.go"), filepath.Join(dir, "a_test.go")
+	pkg, err := ParseFiles(a)
+	OrFail(err, t)
+	testpkg, err := ParseFiles(a, atest)
+	OrFail(err, t)
+	ensureScope(t, pkg.Scope, "F", "helper")
+	ensureScope(t, testpkg.Scope, "F", "TestHelper", "helper")
+	helper, testhelper := pkg.Scope.Lookup("helper"), testpkg.Scope.Lookup("helper")
+	if pkg.Files[a] == testpkg.Files[a] || helper == testhelper {
+		t.Error("The library and its tests should not share ASTs")
+	}
+	// helper is only used by the tests, and the library object is not used by them at all
+	if n := uses(pkg, helper); n != 0 {
+		t.Error("Expected helper to be unused in the library, used", n, "times")
+	}
+	if n := uses(testpkg, testhelper); n != 1 {
+		t.Error("Expected helper to be used once with the tests, used", n, "times")
+	}
+	if n := uses(testpkg, helper); n != 0 {
+		t.Error("Expected the tests not to use the object of the library, used", n, "times")
+	}
+}
+
+// uses counts the identifiers of pkg referring to the function obj, other than its declaration.
+// The parser leaves identifiers declared in another file unresolved, they refer to the object of
+// the package scope.
+func uses(pkg *PatchablePkg, obj *ast.Object) int {
+	n := 0
+	for _, file := range pkg.Files {
+		unresolved := map[*ast.Ident]bool{}
+		for _, ident := range file.File.Unresolved {
+			unresolved[ident] = true
+		}
+		ast.Inspect(file.File, func(nd ast.Node) bool {
+			ident, ok := nd.(*ast.Ident)
+			if !ok || ident == obj.Decl.(*ast.FuncDecl).Name {
+				return true
+			}
+			if ident.Obj == obj || unresolved[ident] && pkg.Scope.Lookup(ident.Name) == obj {
+				n++
+			}
+			return true
+		})
+	}
+	return n
+}
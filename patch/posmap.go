@@ -0,0 +1,160 @@
+package patch
+
+import (
+	"go/token"
+	"sort"
+)
+
+// PosMap maps positions in the output of FprintPatchedMap back to the original file, and
+// positions in the original file to the output.
+// Lines and columns are 1 based, and columns are counted in bytes, as in token.Position.
+type PosMap struct {
+	filename  string
+	segments  []segment
+	origLines []int
+	lines     []int
+}
+
+// segment is a contiguous part of the patched output. If inserted is set, its text was added by
+// a patch at offset orig of the original file, otherwise it was copied from offset orig. If moved
+// is set, it is part of a node an InsertNodePatch inserted.
+type segment struct {
+	patched  int
+	orig     int
+	length   int
+	inserted bool
+	moved    bool
+}
+
+func newPosMap(filename, orig string) *PosMap {
+	return &PosMap{filename, nil, lineStarts(orig), []int{0}}
+}
+
+func lineStarts(s string) []int {
+	lines := []int{0}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+func (m *PosMap) add(patched, orig, length int, inserted, moved bool, text string) {
+	if length == 0 {
+		return
+	}
+	m.segments = append(m.segments, segment{patched, orig, length, inserted, moved})
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			m.lines = append(m.lines, patched+i+1)
+		}
+	}
+}
+
+// ToOriginalOffset returns the offset in the original file of the byte at offset off of the
+// patched output. Text inserted by a patch is mapped to the offset it was inserted at.
+func (m *PosMap) ToOriginalOffset(off int) int {
+	if len(m.segments) == 0 {
+		return off
+	}
+	i := sort.Search(len(m.segments), func(i int) bool {
+		return m.segments[i].patched+m.segments[i].length > off
+	})
+	if i == len(m.segments) {
+		last := m.segments[i-1]
+		if last.inserted {
+			return last.orig
+		}
+		return last.orig + off - last.patched
+	}
+	if seg := m.segments[i]; !seg.inserted {
+		return seg.orig + off - seg.patched
+	}
+	return m.segments[i].orig
+}
+
+// Inserted reports whether the byte at pos in the patched output was inserted by a patch, rather
+// than copied from the original file or replacing original text. If pos.Line is set, it uses
+// pos.Line and pos.Column, otherwise pos.Offset.
+func (m *PosMap) Inserted(pos token.Position) bool {
+	off := pos.Offset
+	if pos.Line > 0 {
+		off = offset(m.lines, pos.Line, pos.Column)
+	}
+	i := sort.Search(len(m.segments), func(i int) bool {
+		return m.segments[i].patched+m.segments[i].length > off
+	})
+	if i == len(m.segments) || !m.segments[i].inserted {
+		return false
+	}
+	// replaced text is skipped, so the original text after a replacement starts past it
+	for _, seg := range m.segments[i+1:] {
+		if !seg.inserted {
+			return seg.orig == m.segments[i].orig
+		}
+	}
+	return true
+}
+
+// ToOriginal maps pos in the patched output to the original file. If pos.Line is set, it uses
+// pos.Line and pos.Column, otherwise pos.Offset.
+func (m *PosMap) ToOriginal(pos token.Position) token.Position {
+	off := pos.Offset
+	if pos.Line > 0 {
+		off = offset(m.lines, pos.Line, pos.Column)
+	}
+	return position(m.filename, m.origLines, m.ToOriginalOffset(off))
+}
+
+// ToPatchedOffset returns the offset in the patched output of the byte at offset off of the
+// original file. Text a patch removed or replaced is mapped to where it was removed. Text an
+// InsertNodePatch inserted is mapped to its copy, unless it was left in place as well.
+func (m *PosMap) ToPatchedOffset(off int) int {
+	after, moved := 0, -1
+	for _, seg := range m.segments {
+		switch {
+		case seg.inserted:
+		case seg.orig <= off && off < seg.orig+seg.length:
+			if !seg.moved {
+				return seg.patched + off - seg.orig
+			}
+			if moved == -1 {
+				moved = seg.patched + off - seg.orig
+			}
+		case !seg.moved && seg.orig+seg.length <= off:
+			// segments left in place are in the order of the original file
+			after = seg.patched + seg.length
+		}
+	}
+	if moved != -1 {
+		return moved
+	}
+	return after
+}
+
+// ToPatched maps pos in the original file to the patched output, which has no file name. If
+// pos.Line is set, it uses pos.Line and pos.Column, otherwise pos.Offset.
+func (m *PosMap) ToPatched(pos token.Position) token.Position {
+	off := pos.Offset
+	if pos.Line > 0 {
+		off = offset(m.origLines, pos.Line, pos.Column)
+	}
+	return position("", m.lines, m.ToPatchedOffset(off))
+}
+
+func offset(lines []int, line, column int) int {
+	if line > len(lines) {
+		line = len(lines)
+	}
+	off := lines[line-1]
+	if column > 0 {
+		off += column - 1
+	}
+	return off
+}
+
+func position(filename string, lines []int, off int) token.Position {
+	line := sort.Search(len(lines), func(i int) bool { return lines[i] > off })
+	return token.Position{Filename: filename, Offset: off, Line: line, Column: off - lines[line-1] + 1}
+}
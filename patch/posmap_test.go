@@ -0,0 +1,166 @@
+package patch
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"testing"
+)
+
+func TestPosMapToOriginal(t *testing.T) {
+	patchable := parse("package main\nfunc f() {\n\ta, b := 1, 2\n}\n", t)
+	body := patchable.File.Decls[0].(*ast.FuncDecl).Body
+	assign := body.List[0].(*ast.AssignStmt)
+	buf := new(bytes.Buffer)
+	m, _, err := patchable.FprintPatchedMap(buf, patchable.File, Patches{
+		Insert(body.Lbrace+1, "_ = a;"),
+		Replace(assign.Lhs[1], "bb"),
+	})
+	OrFail(err, t)
+	exp := "package main\nfunc f() {_ = a;\n\ta, bb := 1, 2\n}\n"
+	if buf.String() != exp {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+	}
+	for _, c := range []struct {
+		line, col         int
+		origLine, origCol int
+	}{
+		{1, 1, 1, 1},
+		{2, 10, 2, 10},
+		// inserted text maps to where it was inserted
+		{2, 12, 2, 11},
+		{2, 16, 2, 11},
+		{3, 2, 3, 2},
+		// replaced text maps to the start of the replaced node
+		{3, 5, 3, 5},
+		{3, 6, 3, 5},
+		{3, 7, 3, 6},
+		{3, 8, 3, 7},
+		{3, 13, 3, 12},
+		{4, 1, 4, 1},
+	} {
+		orig := m.ToOriginal(token.Position{Line: c.line, Column: c.col})
+		if orig.Line != c.origLine || orig.Column != c.origCol {
+			t.Errorf("%d:%d expected to map to %d:%d got %d:%d", c.line, c.col,
+				c.origLine, c.origCol, orig.Line, orig.Column)
+		}
+	}
+	// only the inserted text is reported as inserted, not the replacement
+	for col, inserted := range map[int]bool{10: false, 11: true, 16: true, 17: false} {
+		if m.Inserted(token.Position{Line: 2, Column: col}) != inserted {
+			t.Errorf("2:%d expected inserted to be %v", col, inserted)
+		}
+	}
+	if m.Inserted(token.Position{Line: 3, Column: 5}) {
+		t.Error("3:5 is replaced, not inserted")
+	}
+}
+
+func OrFail(err error, t *testing.T) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPosMapToPatched(t *testing.T) {
+	patchable := parse("package main\nfunc f() {\n\ta, b := 1, 2\n\tc()\n}\n", t)
+	body := patchable.File.Decls[0].(*ast.FuncDecl).Body
+	assign := body.List[0].(*ast.AssignStmt)
+	buf := new(bytes.Buffer)
+	m, _, err := patchable.FprintPatchedMap(buf, patchable.File, Patches{
+		Insert(body.Lbrace+1, "_ = a;"),
+		Replace(assign.Lhs[1], "bb"),
+		Remove(body.List[1]),
+	})
+	OrFail(err, t)
+	exp := "package main\nfunc f() {_ = a;\n\ta, bb := 1, 2\n\t\n}\n"
+	if buf.String() != exp {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", exp, buf.String())
+	}
+	for _, c := range []struct {
+		origLine, origCol int
+		line, col         int
+	}{
+		{1, 1, 1, 1},
+		// text after an insertion follows the inserted text
+		{2, 11, 2, 17},
+		{3, 2, 3, 2},
+		// replaced text maps to the replacing text
+		{3, 5, 3, 5},
+		{3, 6, 3, 7},
+		{3, 13, 3, 14},
+		// removed text maps to where it was removed
+		{4, 2, 4, 2},
+		{4, 4, 4, 2},
+		{5, 1, 5, 1},
+	} {
+		pos := m.ToPatched(token.Position{Line: c.origLine, Column: c.origCol})
+		if pos.Line != c.line || pos.Column != c.col {
+			t.Errorf("%d:%d expected to map to %d:%d got %d:%d", c.origLine, c.origCol,
+				c.line, c.col, pos.Line, pos.Column)
+		}
+	}
+
+	patchable = parse("package kola;func fola()", t)
+	buf.Reset()
+	m, _, err = patchable.FprintPatchedMap(buf, patchable.File, Patches{
+		Remove(patchable.File.Decls[0]),
+		InsertNode(patchable.File.Name.Pos(), patchable.File.Decls[0]),
+	})
+	OrFail(err, t)
+	for _, c := range [][2]int{{0, 0}, {8, 19}, {13, 8}, {18, 13}, {24, 24}} {
+		// the moved declaration maps to its copy, and the end of the file to the end of the output
+		if off := m.ToPatchedOffset(c[0]); off != c[1] {
+			t.Errorf("%d expected to map to %d got %d", c[0], c[1], off)
+		}
+	}
+}
+
+// checkPosMap checks that m maps every byte of out, the output of patchable, to an original byte
+// with the same text, and every original byte to out, the same way.
+func checkPosMap(t *testing.T, patchable *PatchableFile, out string, m *PosMap) {
+	orig := patchable.Orig
+	copied := make(map[int]bool)
+	patched := 0
+	for _, seg := range m.segments {
+		if seg.patched != patched {
+			t.Errorf("%q: segment at %d should follow the previous one at %d", out, seg.patched, patched)
+		}
+		patched += seg.length
+		for i := seg.patched; i < seg.patched+seg.length; i++ {
+			off := m.ToOriginalOffset(i)
+			switch {
+			case seg.inserted && off != seg.orig:
+				t.Errorf("%q: inserted byte %d should map to %d got %d", out, i, seg.orig, off)
+			case !seg.inserted && orig[off] != out[i]:
+				t.Errorf("%q: byte %d %q maps to %d %q", out, i, out[i], off, orig[off])
+			}
+			if !seg.inserted {
+				copied[off] = true
+			}
+		}
+	}
+	if patched != len(out) {
+		t.Errorf("%q: segments cover %d bytes of %d", out, patched, len(out))
+	}
+	lines := lineStarts(out)
+	for off := 0; off <= len(orig); off++ {
+		pos := m.ToPatched(position("", m.origLines, off))
+		if pos.Offset < 0 || pos.Offset > len(out) {
+			t.Errorf("%q: %d maps out of the output to %d", out, off, pos.Offset)
+			continue
+		}
+		if exp := position("", lines, m.ToPatchedOffset(off)); pos != exp {
+			t.Errorf("%q: %d expected to map to %v got %v", out, off, exp, pos)
+		}
+		if !copied[off] {
+			continue
+		}
+		if out[pos.Offset] != orig[off] {
+			t.Errorf("%q: byte %d %q maps to %d %q", out, off, orig[off], pos.Offset, out[pos.Offset])
+		}
+		if back := m.ToOriginal(pos); back.Offset != off {
+			t.Errorf("%q: %d maps to %v which maps back to %d", out, off, pos, back.Offset)
+		}
+	}
+}
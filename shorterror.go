@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/token"
+	"path/filepath"
 	"strings"
+	"unicode"
 
 	"github.com/elazarl/gosloppy/patch"
 )
@@ -19,6 +22,8 @@ type ShortError struct {
 	block   *ast.BlockStmt
 	tmpvar  int
 	initTxt *[]byte
+	// fileid makes package level temporaries of this file distinct from other files' ones
+	fileid string
 }
 
 func (v *ShortError) SetFile(file *patch.PatchableFile) *ShortError {
@@ -26,9 +31,31 @@ func (v *ShortError) SetFile(file *patch.PatchableFile) *ShortError {
 	v.patches = new(patch.Patches)
 	v.stmt, v.block = nil, nil
 	v.initTxt = new([]byte)
+	v.fileid = fileid(file.FileName)
 	return v
 }
 
+// fileid returns an identifier suffix distinct for every file name in the package directory.
+// Letters and digits are kept, "_" is doubled, and other characters are written as "_<hex>_", so
+// that a-b.go and a_b.go get a_2d_b_ and a__b_.
+func fileid(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	for _, r := range strings.TrimSuffix(filepath.Base(filename), ".go") {
+		switch {
+		case r == '_':
+			buf.WriteString("__")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			buf.WriteRune(r)
+		default:
+			fmt.Fprintf(buf, "_%x_", r)
+		}
+	}
+	return buf.String() + "_"
+}
+
 func (v *ShortError) Patches() patch.Patches {
 	return *v.patches
 }
@@ -44,6 +71,12 @@ func (v *ShortError) tempVar(stem string, scope *ast.Scope) string {
 	panic(">100,000 temporary variables used. Either the code is crazy, or I am.")
 }
 
+// tldVar is like tempVar, but for package level variables. Since files are instrumented
+// independently, they must be unique among all files of the package.
+func (v *ShortError) tldVar(stem string, scope *ast.Scope) string {
+	return v.tempVar(stem+v.fileid, scope)
+}
+
 var MustKeyword = "must"
 
 // Yeah yeah, O(n^2) in the worst case. If you use so much must
@@ -73,15 +106,16 @@ func (v *ShortError) VisitExpr(scope *ast.Scope, expr ast.Expr) ScopeVisitor {
 				fmt.Printf("%s:%d:%d: 'must' builtin must be called with exactly one argument\n", pos.Filename, pos.Line, pos.Column)
 				return nil
 			}
-			tmpVar, tmpErr := v.tempVar("tmp_", scope), v.tempVar("err_", scope)
 			mustexpr := v.file.Get(expr.Args[0])
 			if v.block == nil {
+				tmpVar, tmpErr := v.tldVar("tmp_", scope), v.tldVar("err_", scope)
 				// if in top level decleration
 				v.addToInit("if " + tmpErr + " != nil {panic(" + tmpErr + ")};")
 				*v.patches = append(*v.patches,
 					patch.Replace(expr, tmpVar),
 					patch.Insert(afterImports(v.file.File), ";var "+tmpVar+", "+tmpErr+" = "+mustexpr))
 			} else {
+				tmpVar, tmpErr := v.tempVar("tmp_", scope), v.tempVar("err_", scope)
 				*v.patches = append(*v.patches, patch.Insert(v.stmt.Pos(),
 					fmt.Sprint("var ", tmpVar, ", ", tmpErr, " = ", mustexpr, "; ",
 						"if ", tmpErr, " != nil {panic(", tmpErr, ")};")))
@@ -106,7 +140,7 @@ func (v *ShortError) VisitDecl(scope *ast.Scope, decl ast.Decl) ScopeVisitor {
 						fmt.Printf("%s:%d:%d: 'must' builtin must be called with exactly one argument\n", pos.Filename, pos.Line, pos.Column)
 						return nil
 					}
-					tmpErr := v.tempVar("tlderr_", scope)
+					tmpErr := v.tldVar("tlderr_", scope)
 					*v.patches = append(*v.patches,
 						patch.Insert(spec.Names[len(spec.Names)-1].End(), ", "+tmpErr),
 						patch.Replace(fun, v.file.Get(fun.Args[0])))
@@ -134,7 +168,7 @@ func (v *ShortError) VisitStmt(scope *ast.Scope, stmt ast.Stmt) ScopeVisitor {
 	v.stmt = stmt
 	switch stmt := stmt.(type) {
 	case *ast.BlockStmt:
-		return &ShortError{v.file, v.patches, v.stmt, stmt, 0, new([]byte)}
+		return &ShortError{v.file, v.patches, v.stmt, stmt, 0, new([]byte), v.fileid}
 	case *ast.ExprStmt:
 		if call := calltomust(stmt.X); call != nil {
 			// TODO(elazarl): depends on number of variables it returns, currently we assume one
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestFileID(t *testing.T) {
+	ids := map[string]string{}
+	for _, name := range []string{"a.go", "a_b.go", "a-b.go", "a.b.go", "a__b.go", "a_2d_b.go", "a_.go", "a__.go", "dir/ab.go"} {
+		id := fileid(name)
+		if other, ok := ids[id]; ok {
+			t.Errorf("%s and %s have the same id %s", other, name, id)
+		}
+		ids[id] = name
+	}
+	if id := fileid("a-b.go"); id != "a_2d_b_" {
+		t.Error("Expected a_2d_b_ got", id)
+	}
+}
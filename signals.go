@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Interrupts forwards SIGINT and SIGTERM to the child process gosloppy currently runs. SIGINT is
+// not forwarded to a child in the foreground process group of the terminal, which gets SIGINT
+// typed at the terminal along with gosloppy, and would get it twice.
+// When no child is running, it runs the cleanup functions and exits, as the default
+// signal handler would have done, minus leaving the temporary dir behind.
+type Interrupts struct {
+	mu      sync.Mutex
+	child   *os.Process
+	cleanup []func()
+}
+
+func HandleInterrupts() *Interrupts {
+	in := &Interrupts{}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			in.interrupt(sig)
+		}
+	}()
+	return in
+}
+
+func (in *Interrupts) interrupt(sig os.Signal) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.child != nil {
+		// the child would exit, and we'll return its exit status, cleaning up on the way
+		if sig != os.Interrupt || !foreground(in.child) {
+			in.child.Signal(sig)
+		}
+		return
+	}
+	in.runCleanup()
+	if sig, ok := sig.(syscall.Signal); ok {
+		os.Exit(128 + int(sig))
+	}
+	os.Exit(1)
+}
+
+// OnInterrupt registers f to be called if gosloppy is interrupted while no child is running.
+func (in *Interrupts) OnInterrupt(f func()) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.cleanup = append(in.cleanup, f)
+}
+
+func (in *Interrupts) runCleanup() {
+	for i := len(in.cleanup) - 1; i >= 0; i-- {
+		in.cleanup[i]()
+	}
+	in.cleanup = nil
+}
+
+// Run runs cmd, forwarding signals to it while it runs.
+func (in *Interrupts) Run(cmd *exec.Cmd) error {
+	in.mu.Lock()
+	if err := cmd.Start(); err != nil {
+		in.mu.Unlock()
+		return err
+	}
+	in.child = cmd.Process
+	in.mu.Unlock()
+	err := cmd.Wait()
+	in.mu.Lock()
+	in.child = nil
+	in.mu.Unlock()
+	return err
+}
+
+// exitStatus returns the exit status a shell would report for a process that ended with err.
+// ok is false if err does not describe a process exit.
+func exitStatus(err error) (status int, ok bool) {
+	exiterr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	if ws, ok := exiterr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), true
+	}
+	return exiterr.ExitCode(), true
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// foreground reports whether p is in the foreground process group of the controlling terminal,
+// which is never known here.
+func foreground(p *os.Process) bool {
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a posix shell")
+	}
+	for _, c := range []struct {
+		script string
+		status int
+	}{
+		{"exit 3", 3},
+		{"exit 0", 0},
+		{"kill -TERM $$", 128 + 15},
+	} {
+		err := exec.Command("sh", "-c", c.script).Run()
+		if c.status == 0 {
+			if err != nil {
+				t.Error(c.script, "unexpected error", err)
+			}
+			continue
+		}
+		if status, ok := exitStatus(err); !ok || status != c.status {
+			t.Errorf("%s: expected exit status %d got %d (%v)", c.script, c.status, status, err)
+		}
+	}
+	if _, ok := exitStatus(errors.New("not an exit")); ok {
+		t.Error("non exit error reported as exit status")
+	}
+}
+
+func TestInterruptChild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a posix shell")
+	}
+	in := &Interrupts{}
+	cmd := exec.Command("sh", "-c", "trap 'echo int' INT; trap 'exit 3' TERM; echo ready; while :; do sleep 0.01; done")
+	// the child writes to the pipe directly, which is read while Run waits for it
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd.Stdout = w
+	done := make(chan error)
+	go func() { done <- in.Run(cmd) }()
+	stdout := bufio.NewReader(r)
+	if line, err := stdout.ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatal("child did not start", line, err)
+	}
+	w.Close()
+	// a child in the foreground of the terminal got SIGINT from it already, others get it from us
+	forwarded := !foreground(cmd.Process)
+	in.interrupt(os.Interrupt)
+	if forwarded {
+		if line, err := stdout.ReadString('\n'); err != nil || line != "int\n" {
+			t.Error("expected SIGINT forwarded to the child, got", line, err)
+		}
+	}
+	in.interrupt(syscall.SIGTERM)
+	rest, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Error(err)
+	}
+	if status, ok := exitStatus(<-done); !ok || status != 3 {
+		t.Errorf("expected the child to exit with the status of its SIGTERM trap, got %d", status)
+	}
+	if len(rest) != 0 {
+		t.Errorf("expected no more output, the child printed %q", rest)
+	}
+}
@@ -15,8 +15,9 @@ func anonymousImport(name *ast.Ident) bool {
 	return name != nil && (name.Name == "_" || name.Name == ".")
 }
 
-func NewUnusedVisitor(v Visitor) *UnusedVisitor {
-	return &UnusedVisitor{make(map[*ast.Object]bool), make(map[*ast.Ident]bool), make(map[string]bool), v}
+// NewUnusedVisitor reports the unused objects and imports of a file in dir to v.
+func NewUnusedVisitor(v Visitor, dir string) *UnusedVisitor {
+	return &UnusedVisitor{make(map[*ast.Object]bool), make(map[*ast.Ident]bool), make(map[string]bool), v, dir}
 }
 
 type UnusedVisitor struct {
@@ -24,6 +25,8 @@ type UnusedVisitor struct {
 	Irrelevant  map[*ast.Ident]bool
 	UsedImports map[string]bool
 	Visitor     Visitor
+	// Dir is the directory of the file, imported packages are resolved from it
+	Dir string
 }
 
 func (v *UnusedVisitor) VisitStmt(*ast.Scope, ast.Stmt) ScopeVisitor {
@@ -64,7 +67,7 @@ func (v *UnusedVisitor) ExitScope(scope *ast.Scope, node ast.Node, last bool) Sc
 	}
 	if file, ok := node.(*ast.File); ok {
 		for _, imp := range file.Imports {
-			name := imports.GetNameOrGuess(imp)
+			name := imports.GetNameOrGuessFrom(imp, v.Dir)
 			if !v.UsedImports[name] && !anonymousImport(imp.Name) {
 				v.Visitor.UnusedImport(imp)
 			}
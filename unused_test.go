@@ -37,7 +37,7 @@ func TestSimpleUnused(t *testing.T) {
 		unused := []string{}
 		WalkFile(NewUnusedVisitor(unusedNames(func(name string) {
 			unused = append(unused, name)
-		})), file)
+		}), "."), file)
 		if fmt.Sprint(unused) != fmt.Sprint(c.expUnused) {
 			t.Errorf("Case #%d:\n%s\n Expected unused %v got %v", i, c.body, c.expUnused, unused)
 		}